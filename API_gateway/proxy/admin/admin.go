@@ -0,0 +1,161 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"proxy/config"
+	"proxy/database"
+	"proxy/upstream"
+)
+
+// API serves the operator endpoints on the metrics listener
+type API struct {
+	Pool *upstream.Pool
+	Keys KeyManager
+}
+
+// KeyManager revokes API keys and drops them from the key cache
+type KeyManager interface {
+	Revoke(apiKey string) error
+	Evict(apiKey string)
+}
+
+// Register mounts the admin routes on mux. Every route requires
+// "Authorization: Bearer <ADMIN_TOKEN>"; if ADMIN_TOKEN is unset the admin
+// API is not exposed at all.
+func (a *API) Register(mux *http.ServeMux) {
+	token := config.LoadAdminToken()
+	if token == "" {
+		log.Println("ADMIN_TOKEN not set, admin API disabled")
+		return
+	}
+
+	mux.Handle("/admin/upstreams", requireToken(token, http.HandlerFunc(a.upstreams)))
+	if a.Keys != nil {
+		mux.Handle("/admin/keys/revoke", requireToken(token, http.HandlerFunc(a.revokeKey)))
+		mux.Handle("/admin/keys/evict", requireToken(token, http.HandlerFunc(a.evictKey)))
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type endpointStatus struct {
+	Endpoint  string  `json:"endpoint"`
+	Healthy   bool    `json:"healthy"`
+	Circuit   string  `json:"circuit"`
+	Height    uint64  `json:"height"`
+	InFlight  int64   `json:"in_flight"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+type chainStatus struct {
+	Type   string           `json:"type"`
+	Leader uint64           `json:"leader"`
+	HTTP   []endpointStatus `json:"http"`
+	WS     []endpointStatus `json:"ws"`
+}
+
+// upstreams reports the runtime state of every upstream endpoint
+func (a *API) upstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	status := func(eps []*upstream.Endpoint) []endpointStatus {
+		out := make([]endpointStatus, 0, len(eps))
+		for _, e := range eps {
+			out = append(out, endpointStatus{
+				Endpoint:  e.Label(),
+				Healthy:   e.Healthy(),
+				Circuit:   e.Circuit().String(),
+				Height:    e.Height(),
+				InFlight:  e.InFlight(),
+				LatencyMs: float64(e.Latency().Microseconds()) / 1000,
+			})
+		}
+		return out
+	}
+
+	chains := map[string]chainStatus{}
+	for _, c := range a.Pool.Chains() {
+		chains[c.Name] = chainStatus{
+			Type:   c.Type,
+			Leader: c.Leader(),
+			HTTP:   status(c.HTTP),
+			WS:     status(c.WS),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"chains": chains})
+}
+
+type keyRequest struct {
+	APIKey string `json:"api_key"`
+}
+
+// readKeyRequest decodes the key named in a POST body, writing an error
+// response and returning "" if there is none
+func readKeyRequest(w http.ResponseWriter, r *http.Request) string {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return ""
+	}
+	var req keyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.APIKey == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `expected {"api_key": "..."}`})
+		return ""
+	}
+	return req.APIKey
+}
+
+// revokeKey disables a key in the key store and drops it from the caches
+func (a *API) revokeKey(w http.ResponseWriter, r *http.Request) {
+	apiKey := readKeyRequest(w, r)
+	if apiKey == "" {
+		return
+	}
+	if err := a.Keys.Revoke(apiKey); err != nil {
+		if errors.Is(err, database.ErrKeyNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown api key"})
+			return
+		}
+		log.Printf("Error revoking API key: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// evictKey drops a key from the key cache so its current row is read on the
+// next request, e.g. after editing it in the database
+func (a *API) evictKey(w http.ResponseWriter, r *http.Request) {
+	apiKey := readKeyRequest(w, r)
+	if apiKey == "" {
+		return
+	}
+	a.Keys.Evict(apiKey)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "evicted"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing admin response: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// Signature algorithms accepted in a token's alg header
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// jwk is a JSON Web Key as found in a JWKS file (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"` // oct
+	N   string `json:"n"` // RSA
+	E   string `json:"e"` // RSA
+	Crv string `json:"crv"`
+	X   string `json:"x"` // OKP
+}
+
+// verificationKey is a key from a JWKS file and the one algorithm it may be
+// used with, so that e.g. an RSA public key can never act as an HMAC secret
+type verificationKey struct {
+	kid string
+	alg string
+	key any // []byte, *rsa.PublicKey or ed25519.PublicKey
+}
+
+// loadJWKS reads the signature verification keys in a JWKS file. Keys
+// marked for encryption are skipped.
+func loadJWKS(path string) ([]verificationKey, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var keys []verificationKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %w", path, i, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signing keys", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) parse() (verificationKey, error) {
+	vk := verificationKey{kid: k.Kid}
+	switch k.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) < 32 {
+			return vk, errors.New("oct key needs a base64url k of at least 32 bytes")
+		}
+		vk.alg, vk.key = HS256, secret
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return vk, errors.New("RSA key needs base64url n and e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return vk, errors.New("RSA key is shorter than 2048 bits")
+		}
+		vk.alg, vk.key = RS256, pub
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return vk, errors.New("OKP key needs crv Ed25519 and a base64url x")
+		}
+		vk.alg, vk.key = EdDSA, ed25519.PublicKey(x)
+	default:
+		return vk, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+	if k.Alg != "" && k.Alg != vk.alg {
+		return vk, fmt.Errorf("unsupported alg %q for kty %s", k.Alg, k.Kty)
+	}
+	return vk, nil
+}
+
+// verify reports whether sig is a valid signature of signingInput
+func (k verificationKey) verify(signingInput, sig []byte) bool {
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signingInput)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signingInput, sig)
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"proxy/config"
+	"proxy/database"
+	"proxy/metrics"
+	"proxy/utils"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token has expired")
+)
+
+// verifier checks tokens against the configured issuers. It is nil while no
+// issuer is configured.
+var verifier atomic.Pointer[Verifier]
+
+// subjectHasher derives the key ID of a token's issuer and subject
+var subjectHasher = database.NewKeyHasher("")
+
+// Configure applies the jwt section of the config, reading every issuer's
+// JWKS file. If a file can't be loaded the previous issuers stay in effect.
+func Configure(cfg config.JWT) error {
+	if len(cfg.Issuers) == 0 {
+		verifier.Store(nil)
+		return nil
+	}
+	v := &Verifier{issuers: make(map[string]*issuer, len(cfg.Issuers)), leeway: cfg.Leeway}
+	for _, iss := range cfg.Issuers {
+		keys, err := loadJWKS(iss.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("jwt issuer %s: %w", iss.Issuer, err)
+		}
+		v.issuers[iss.Issuer] = &issuer{cfg: iss, keys: keys}
+	}
+	verifier.Store(v)
+	return nil
+}
+
+// Enabled reports whether tokens are accepted at all
+func Enabled() bool {
+	return verifier.Load() != nil
+}
+
+// LooksLikeToken reports whether a credential is a JWT rather than an API
+// key: three dot-separated parts, the first a base64url JSON object
+func LooksLikeToken(credential string) bool {
+	return strings.HasPrefix(credential, "eyJ") && strings.Count(credential, ".") == 2
+}
+
+// Verify checks a token with the current issuers and returns the key it
+// stands for
+func Verify(token string) (*database.KeyInfo, error) {
+	v := verifier.Load()
+	if v == nil {
+		return nil, fmt.Errorf("%w: no issuers configured", ErrInvalidToken)
+	}
+	return v.Verify(token, utils.Now())
+}
+
+// Verifier checks JWTs against a set of trusted issuers
+type Verifier struct {
+	issuers map[string]*issuer
+	leeway  time.Duration
+}
+
+type issuer struct {
+	cfg  config.JWTIssuer
+	keys []verificationKey
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// claims are the registered claims checked by the gateway and the private
+// ones that map onto a KeyInfo
+type claims struct {
+	Issuer       string     `json:"iss"`
+	Subject      string     `json:"sub"`
+	Audience     audience   `json:"aud"`
+	ExpiresAt    *float64   `json:"exp"`
+	NotBefore    *float64   `json:"nbf"`
+	Org          string     `json:"org"`
+	OrgID        flexString `json:"org_id"`
+	Chain        string     `json:"chain"`
+	Chains       []string   `json:"chains"`
+	Limit        int        `json:"limit"`
+	RPS          float64    `json:"rate_limit_rps"`
+	Burst        int        `json:"rate_limit_burst"`
+	QuotaPeriod  string     `json:"quota_period"`
+	MaxBatchSize int        `json:"max_batch_size"`
+	Plan         string     `json:"plan"`
+}
+
+// Verify checks the signature and claims of token at now. Tokens must carry
+// iss, sub and exp; the issuer's settings take precedence over their claims.
+func (v *Verifier) Verify(token string, now time.Time) (*database.KeyInfo, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	var h header
+	var c claims
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	// Unknown issuers share one label to keep the metric's cardinality bounded
+	iss, ok := v.issuers[c.Issuer]
+	if !ok {
+		metrics.JWTVerifications.WithLabelValues("unknown", "invalid").Inc()
+		return nil, fmt.Errorf("%w: unknown issuer %q", ErrInvalidToken, c.Issuer)
+	}
+
+	key, err := iss.check(h, c, []byte(parts[0]+"."+parts[1]), sig, now, v.leeway)
+	result := "ok"
+	if errors.Is(err, ErrTokenExpired) {
+		result = "expired"
+	} else if err != nil {
+		result = "invalid"
+	}
+	metrics.JWTVerifications.WithLabelValues(c.Issuer, result).Inc()
+	return key, err
+}
+
+func (iss *issuer) check(h header, c claims, signingInput, sig []byte, now time.Time, leeway time.Duration) (*database.KeyInfo, error) {
+	verified := false
+	for _, k := range iss.keys {
+		if k.alg == h.Alg && (h.Kid == "" || h.Kid == k.kid) && k.verify(signingInput, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	if c.Subject == "" || c.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: sub and exp are required", ErrInvalidToken)
+	}
+	expiresAt := time.Unix(int64(*c.ExpiresAt), 0).Add(leeway)
+	if !now.Before(expiresAt) {
+		return nil, ErrTokenExpired
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(time.Unix(int64(*c.NotBefore), 0)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if iss.cfg.Audience != "" && !slices.Contains(c.Audience, iss.cfg.Audience) {
+		return nil, fmt.Errorf("%w: audience", ErrInvalidToken)
+	}
+
+	return iss.keyInfo(c, expiresAt)
+}
+
+// keyInfo maps the claims of a verified token onto a key. The quota is
+// shared by every token the issuer mints for the same subject.
+func (iss *issuer) keyInfo(c claims, expiresAt time.Time) (*database.KeyInfo, error) {
+	key := &database.KeyInfo{
+		ID:           subjectHasher.ID(c.Issuer + " " + c.Subject),
+		Chain:        c.Chain,
+		Org:          c.Org,
+		OrgID:        string(c.OrgID),
+		Limit:        c.Limit,
+		RPS:          c.RPS,
+		Burst:        c.Burst,
+		QuotaPeriod:  c.QuotaPeriod,
+		MaxBatchSize: c.MaxBatchSize,
+		Enabled:      true,
+		ExpiresAt:    expiresAt,
+		Plan:         c.Plan,
+	}
+	if iss.cfg.Org != "" {
+		key.Org = iss.cfg.Org
+	}
+	if iss.cfg.OrgID != "" {
+		key.OrgID = iss.cfg.OrgID
+	}
+	// A limit of 0 means unlimited, so tokens never get one: config
+	// validation requires every issuer to set a limit
+	if limit := iss.cfg.Limit; key.Limit <= 0 || key.Limit > limit {
+		key.Limit = limit
+	}
+
+	if key.Chain == "" && len(c.Chains) > 0 {
+		key.Chain = c.Chains[0]
+	}
+	if key.Chain == "" {
+		return nil, fmt.Errorf("%w: no chain claim", ErrInvalidToken)
+	}
+	if !iss.allowsChain(key.Chain) {
+		return nil, fmt.Errorf("%w: chain %s not allowed for issuer", ErrInvalidToken, key.Chain)
+	}
+	for _, chain := range c.Chains {
+		if chain == "*" && !iss.allowsChain("*") {
+			key.AllowedChains = append(key.AllowedChains, iss.cfg.Chains...)
+		} else if iss.allowsChain(chain) {
+			key.AllowedChains = append(key.AllowedChains, chain)
+		}
+	}
+	return key, nil
+}
+
+func (iss *issuer) allowsChain(chain string) bool {
+	return len(iss.cfg.Chains) == 0 || slices.Contains(iss.cfg.Chains, "*") || slices.Contains(iss.cfg.Chains, chain)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audience is the aud claim, either a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// flexString accepts a claim given as a string or a number, such as org_id
+type flexString string
+
+func (s *flexString) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		return json.Unmarshal(data, (*string)(s))
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*s = flexString(n)
+	return nil
+}
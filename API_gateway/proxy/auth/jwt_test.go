@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+const testIssuer = "https://auth.example.com"
+
+// testKeys are the private halves of the keys in the test JWKS file
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ed     ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{secret: []byte("0123456789abcdef0123456789abcdef"), rsa: rsaKey, ed: edKey}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// writeJWKS writes the public keys to a JWKS file with kids hs, rs and ed
+func writeJWKS(t *testing.T, keys testKeys) string {
+	t.Helper()
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "k": b64(keys.secret)},
+		{"kty": "RSA", "kid": "rs", "n": b64(keys.rsa.N.Bytes()), "e": b64(big.NewInt(int64(keys.rsa.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(keys.ed.Public().(ed25519.PublicKey))},
+	}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sign builds a token with the given header and claims, signed by key as
+// alg. Unknown algs, such as none, get an empty signature.
+func sign(t *testing.T, alg, kid string, claims map[string]any, key any) string {
+	t.Helper()
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	}
+	return input + "." + b64(sig)
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	jwks, err := loadJWKS(writeJWKS(t, keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{
+		issuers: map[string]*issuer{testIssuer: {
+			cfg:  config.JWTIssuer{Issuer: testIssuer, Audience: "gateway", Limit: 1000},
+			keys: jwks,
+		}},
+		leeway: time.Minute,
+	}
+
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   testIssuer,
+			"sub":   "user-1",
+			"aud":   "gateway",
+			"exp":   now.Add(time.Hour).Unix(),
+			"chain": "ethereum",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	valid := claims(nil)
+	rsaPublic := keys.rsa.N.Bytes()
+
+	tests := []struct {
+		name  string
+		token string
+		err   error // nil if the token is accepted
+	}{
+		{"HS256", sign(t, HS256, "hs", valid, keys.secret), nil},
+		{"RS256", sign(t, RS256, "rs", valid, keys.rsa), nil},
+		{"EdDSA", sign(t, EdDSA, "ed", valid, keys.ed), nil},
+		{"no kid tries every key", sign(t, RS256, "", valid, keys.rsa), nil},
+		{"audience list", sign(t, EdDSA, "ed", claims(map[string]any{"aud": []string{"other", "gateway"}}), keys.ed), nil},
+		{"expired within leeway", sign(t, EdDSA, "ed", claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()}), keys.ed), nil},
+
+		{"bad signature", sign(t, HS256, "hs", valid, []byte("another secret of thirty-two bytes")), ErrInvalidToken},
+		{"tampered claims", tamper(sign(t, EdDSA, "ed", valid, keys.ed), claims(map[string]any{"sub": "admin"})), ErrInvalidToken},
+		{"alg none", sign(t, "none", "", valid, nil), ErrInvalidToken},
+		{"alg mismatch", sign(t, RS256, "hs", valid, keys.secret), ErrInvalidToken},
+		{"RSA public key as HMAC secret", sign(t, HS256, "rs", valid, rsaPublic), ErrInvalidToken},
+		{"EdDSA token under an RSA kid", sign(t, EdDSA, "rs", valid, keys.ed), ErrInvalidToken},
+		{"unknown kid", sign(t, HS256, "gone", valid, keys.secret), ErrInvalidToken},
+		{"wrong issuer", sign(t, HS256, "hs", claims(map[string]any{"iss": "https://evil.example.com"}), keys.secret), ErrInvalidToken},
+		{"wrong audience", sign(t, HS256, "hs", claims(map[string]any{"aud": "other"}), keys.secret), ErrInvalidToken},
+		{"missing audience", sign(t, HS256, "hs", claims(map[string]any{"aud": nil}), keys.secret), ErrInvalidToken},
+		{"missing exp", sign(t, HS256, "hs", claims(map[string]any{"exp": nil}), keys.secret), ErrInvalidToken},
+		{"missing sub", sign(t, HS256, "hs", claims(map[string]any{"sub": nil}), keys.secret), ErrInvalidToken},
+		{"expired", sign(t, HS256, "hs", claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()}), keys.secret), ErrTokenExpired},
+		{"not yet valid", sign(t, HS256, "hs", claims(map[string]any{"nbf": now.Add(2 * time.Minute).Unix()}), keys.secret), ErrInvalidToken},
+		{"malformed", "eyJhbGciOiJIUzI1NiJ9.e30", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := v.Verify(tt.token, now)
+			if tt.err == nil {
+				if err != nil || key == nil {
+					t.Fatalf("Verify = %v, %v; want a key", key, err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) || key != nil {
+				t.Errorf("Verify = %v, %v; want %v", key, err, tt.err)
+			}
+		})
+	}
+}
+
+// tamper replaces the claims of a signed token, keeping its signature
+func tamper(token string, claims map[string]any) string {
+	c, _ := json.Marshal(claims)
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + b64(c) + "." + parts[2]
+}
+
+func TestVerifyLimit(t *testing.T) {
+	keys := newTestKeys(t)
+	v := &Verifier{issuers: map[string]*issuer{testIssuer: {
+		cfg:  config.JWTIssuer{Issuer: testIssuer, Limit: 1000},
+		keys: []verificationKey{{kid: "hs", alg: HS256, key: keys.secret}},
+	}}}
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		claim any // nil for no limit claim
+		limit int
+	}{
+		{"no claim gets the issuer's limit", nil, 1000},
+		{"zero claim is not unlimited", 0, 1000},
+		{"claim below the cap", 10, 10},
+		{"claim above the cap", 5000, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]any{"iss": testIssuer, "sub": "user-1", "exp": now.Add(time.Hour).Unix(), "chain": "ethereum"}
+			if tt.claim != nil {
+				claims["limit"] = tt.claim
+			}
+			key, err := v.Verify(sign(t, HS256, "hs", claims, keys.secret), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Limit != tt.limit {
+				t.Errorf("Limit = %d, want %d", key.Limit, tt.limit)
+			}
+		})
+	}
+}
+
+func TestJWKParse(t *testing.T) {
+	keys := newTestKeys(t)
+	n, e := b64(keys.rsa.N.Bytes()), b64(big.NewInt(int64(keys.rsa.E)).Bytes())
+	x := b64(keys.ed.Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		name string
+		key  jwk
+		alg  string // "" if the key is refused
+	}{
+		{"oct", jwk{Kty: "oct", K: b64(keys.secret)}, HS256},
+		{"RSA", jwk{Kty: "RSA", N: n, E: e, Alg: RS256}, RS256},
+		{"OKP", jwk{Kty: "OKP", Crv: "Ed25519", X: x}, EdDSA},
+		{"short oct secret", jwk{Kty: "oct", K: b64([]byte("short"))}, ""},
+		{"RSA key marked HS256", jwk{Kty: "RSA", N: n, E: e, Alg: HS256}, ""},
+		{"oct key marked RS256", jwk{Kty: "oct", K: b64(keys.secret), Alg: RS256}, ""},
+		{"OKP key marked none", jwk{Kty: "OKP", Crv: "Ed25519", X: x, Alg: "none"}, ""},
+		{"short RSA modulus", jwk{Kty: "RSA", N: b64(big.NewInt(1<<62 + 1).Bytes()), E: e}, ""},
+		{"OKP on another curve", jwk{Kty: "OKP", Crv: "X25519", X: x}, ""},
+		{"EC", jwk{Kty: "EC", Crv: "P-256"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vk, err := tt.key.parse()
+			if tt.alg == "" {
+				if err == nil {
+					t.Errorf("parse accepted the key as %s", vk.alg)
+				}
+				return
+			}
+			if err != nil || vk.alg != tt.alg {
+				t.Errorf("parse = %s, %v; want %s", vk.alg, err, tt.alg)
+			}
+		})
+	}
+}
@@ -3,8 +3,14 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,64 +19,474 @@ func LoadDBConfig() (string, string, string, string, string) {
 	return os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_NAME")
 }
 
+// LoadDBDriver returns the database driver (DB_DRIVER: mysql or postgres,
+// default mysql) and the Postgres sslmode (DB_SSLMODE, default the driver's)
+func LoadDBDriver() (string, string) {
+	return os.Getenv("DB_DRIVER"), os.Getenv("DB_SSLMODE")
+}
+
 func LoadProxyConfig() (string, string) {
 	return os.Getenv("PROXY_HOST"), os.Getenv("PROXY_PORT")
 }
 
+// LoadUsageStoreConfig returns where quota usage is kept (USAGE_STORE: memory
+// or sql, default memory) and how often the sql store flushes
+// (USAGE_FLUSH_INTERVAL, default 1s)
+func LoadUsageStoreConfig() (string, time.Duration) {
+	store := os.Getenv("USAGE_STORE")
+	if store == "" {
+		store = "memory"
+	}
+	return store, durationEnv("USAGE_FLUSH_INTERVAL", time.Second)
+}
+
+// LoadKeyHashConfig returns the secret API keys are hashed with
+// (API_KEY_HMAC_SECRET) and how keys are matched in the database
+// (API_KEY_LOOKUP: plaintext, both or hashed; default hashed if a secret is
+// set, plaintext otherwise)
+func LoadKeyHashConfig() (string, string) {
+	secret := os.Getenv("API_KEY_HMAC_SECRET")
+	mode := os.Getenv("API_KEY_LOOKUP")
+	if mode == "" {
+		mode = "plaintext"
+		if secret != "" {
+			mode = "hashed"
+		}
+	}
+	return secret, mode
+}
+
+// LoadKeyStoreConfig returns where API keys are read from (KEY_STORE: sql or
+// file, default sql) and the YAML file used by the file store
+// (KEY_STORE_FILE, default keys.yaml)
+func LoadKeyStoreConfig() (string, string) {
+	store := os.Getenv("KEY_STORE")
+	if store == "" {
+		store = "sql"
+	}
+	file := os.Getenv("KEY_STORE_FILE")
+	if file == "" {
+		file = "keys.yaml"
+	}
+	return store, file
+}
+
+// LoadKeyTransports returns where requests may carry their API key, in order
+// of precedence (KEY_TRANSPORTS, default path,header), the query parameter of
+// the query transport (KEY_QUERY_PARAM, default apikey) and the domain of
+// the subdomain transport (KEY_HOST_SUFFIX)
+func LoadKeyTransports() ([]string, string, string) {
+	var transports []string
+	for _, t := range strings.Split(os.Getenv("KEY_TRANSPORTS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			transports = append(transports, t)
+		}
+	}
+	if len(transports) == 0 {
+		transports = []string{"path", "header"}
+	}
+	param := os.Getenv("KEY_QUERY_PARAM")
+	if param == "" {
+		param = "apikey"
+	}
+	return transports, param, os.Getenv("KEY_HOST_SUFFIX")
+}
+
+// DefaultMaxBatchSize caps JSON-RPC batches for keys without a
+// max_batch_size (DEFAULT_MAX_BATCH_SIZE, default 0 for no cap)
+func DefaultMaxBatchSize() int {
+	n, err := strconv.Atoi(os.Getenv("DEFAULT_MAX_BATCH_SIZE"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// LoadAdminToken returns the bearer token guarding the admin API (ADMIN_TOKEN)
+func LoadAdminToken() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// NegativeKeyCacheTTL returns how long unknown API keys are remembered before
+// the database is asked again (NEGATIVE_KEY_CACHE_TTL, default 1m)
+func NegativeKeyCacheTTL() time.Duration {
+	return durationEnv("NEGATIVE_KEY_CACHE_TTL", time.Minute)
+}
+
+// KeyStaleGrace returns how long expired API key data may still be served
+// while the database is unavailable (KEY_STALE_GRACE, default 0 for never)
+func KeyStaleGrace() time.Duration {
+	return durationEnv("KEY_STALE_GRACE", 0)
+}
+
+// KeyPollInterval returns how often the key store is checked for changed
+// keys (KEY_POLL_INTERVAL, default 30s). 0 disables polling.
+func KeyPollInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("KEY_POLL_INTERVAL")); err == nil && d == 0 {
+		return 0
+	}
+	return durationEnv("KEY_POLL_INTERVAL", 30*time.Second)
+}
+
+// TrustedProxyHops returns how many proxies in front of the gateway append
+// to X-Forwarded-For (TRUST_X_FORWARDED_FOR, default 0). true counts as 1.
+// With 0, client IP allowlists use the connection's address.
+func TrustedProxyHops() int {
+	v := os.Getenv("TRUST_X_FORWARDED_FOR")
+	if trust, err := strconv.ParseBool(v); err == nil {
+		if trust {
+			return 1
+		}
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// LoadCORSConfig returns the request headers browsers may send
+// (CORS_ALLOWED_HEADERS, default Content-Type, Authorization, X-API-Key,
+// solana-client), how long they may cache a preflight (CORS_MAX_AGE, default
+// 10m), whether credentialed requests are allowed (CORS_ALLOW_CREDENTIALS,
+// default false) and the origins that may make them (CORS_CREDENTIAL_ORIGINS)
+func LoadCORSConfig() (string, time.Duration, bool, []string) {
+	headers := os.Getenv("CORS_ALLOWED_HEADERS")
+	if headers == "" {
+		headers = "Content-Type, Authorization, X-API-Key, solana-client"
+	}
+	credentials, _ := strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS"))
+	var origins []string
+	for _, o := range strings.Split(os.Getenv("CORS_CREDENTIAL_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return headers, durationEnv("CORS_MAX_AGE", 10*time.Minute), credentials, origins
+}
+
+// ConfigPath returns the chain config file location (CONFIG_PATH, default config.yaml)
+func ConfigPath() string {
+	cfgPath := os.Getenv("CONFIG_PATH")
+	if cfgPath == "" {
+		cfgPath = "config.yaml"
+	}
+	return cfgPath
+}
+
+// ReloadInterval returns how often the config file is checked for changes (CONFIG_RELOAD_INTERVAL, default 10s)
+func ReloadInterval() time.Duration {
+	return durationEnv("CONFIG_RELOAD_INTERVAL", 10*time.Second)
+}
+
+func durationEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
 type FileConfig struct {
-	Chains map[string]Chain `yaml:"chains"`
+	Chains         map[string]Chain       `yaml:"chains"`
+	HealthChecks   map[string]HealthCheck `yaml:"health_checks"`
+	CircuitBreaker CircuitBreaker         `yaml:"circuit_breaker"`
+	ResponseCache  ResponseCache          `yaml:"response_cache"`
+	JWT            JWT                    `yaml:"jwt"`
 }
 
 type ChainMap struct {
 	HTTPEndpoints      map[string][]string
 	WebSocketEndpoints map[string][]string
+	ChainTypes         map[string]string
+	Chains             map[string]Chain
+	HealthChecks       map[string]HealthCheck
+	CircuitBreaker     CircuitBreaker
+	ResponseCache      ResponseCache
+	JWT                JWT
 }
 
 type Chain struct {
-	Type string     `yaml:"type"`
-	HTTP []Endpoint `yaml:"http"`
-	WS   []Endpoint `yaml:"ws"`
+	Type        string         `yaml:"type"`
+	HTTP        []Endpoint     `yaml:"http"`
+	WS          []Endpoint     `yaml:"ws"`
+	MaxBlockLag uint64         `yaml:"max_block_lag"` // overrides the chain type's health check setting
+	Balancer    string         `yaml:"balancer"`      // round_robin (default), weighted, least_in_flight or ewma
+	Methods     MethodPolicy   `yaml:"methods"`
+	MethodCosts map[string]int `yaml:"method_costs"` // compute units per JSON-RPC method
+	DefaultCost int            `yaml:"default_cost"` // units for unpriced methods and non JSON-RPC requests, default 1
+	// Batches larger than this are split across upstreams and reassembled; 0 never splits
+	BatchSplitSize int `yaml:"batch_split_size"`
+}
+
+// MethodCost returns the compute units charged for one call of method
+func (c Chain) MethodCost(method string) int {
+	if cost, ok := c.MethodCosts[method]; ok {
+		return cost
+	}
+	return max(c.DefaultCost, 1)
+}
+
+// MethodPolicy restricts which JSON-RPC methods may be called. Entries are
+// glob patterns such as "admin_*". A denied method is always refused; when
+// Allow is non-empty only matching methods are let through.
+type MethodPolicy struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	// keyAllow is the allow list of a key, checked on top of the chain's
+	keyAllow []string
+}
+
+// Permits reports whether method may be called under the policy
+func (p MethodPolicy) Permits(method string) bool {
+	if matchAny(p.Deny, method) {
+		return false
+	}
+	return (len(p.Allow) == 0 || matchAny(p.Allow, method)) &&
+		(len(p.keyAllow) == 0 || matchAny(p.keyAllow, method))
 }
 
+// IsEmpty reports whether the policy permits every method
+func (p MethodPolicy) IsEmpty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0 && len(p.keyAllow) == 0
+}
+
+// Override returns the policy narrowed by key's: a method must match both
+// allow lists, where set, and neither deny list, so a key can never call a
+// method its chain does not permit
+func (p MethodPolicy) Override(key MethodPolicy) MethodPolicy {
+	if len(key.Allow) > 0 {
+		p.keyAllow = key.Allow
+	}
+	if len(key.Deny) > 0 {
+		p.Deny = append(slices.Clip(p.Deny), key.Deny...)
+	}
+	return p
+}
+
+func matchAny(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Balancer strategies accepted in Chain.Balancer
+var Balancers = []string{"round_robin", "weighted", "least_in_flight", "ewma"}
+
 type Endpoint struct {
-	URL string `yaml:"url"`
+	URL    string `yaml:"url"`
+	Name   string `yaml:"name"`
+	Weight int    `yaml:"weight"` // relative share for the weighted balancer, default 1
 }
 
-// LoadChainMap now returns three maps:
-// - httpEndpoints[chain] = []httpURLs
-// - wsEndpoints[chain]   = []wsURLs
-// - chainTypes[chain]    = type string
-func LoadChainMap() (map[string][]string, map[string][]string, map[string]string) {
-	cfgPath := os.Getenv("CONFIG_PATH")
-	if cfgPath == "" {
-		cfgPath = "config.yaml"
+// Label identifies the endpoint in logs and metrics without exposing
+// credentials that providers embed in the URL path or query.
+func (e Endpoint) Label() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	if u, err := url.Parse(e.URL); err == nil && u.Host != "" {
+		return u.Host
 	}
+	return "unknown"
+}
+
+// uniqueLabels names endpoints whose label repeats one earlier in eps, such
+// as several keyed URLs on one provider host, host#2, host#3 and so on, so
+// each gets its own metric series
+func uniqueLabels(eps []Endpoint) []Endpoint {
+	seen := make(map[string]int, len(eps))
+	out := make([]Endpoint, len(eps))
+	for i, ep := range eps {
+		label := ep.Label()
+		seen[label]++
+		if n := seen[label]; n > 1 {
+			ep.Name = fmt.Sprintf("%s#%d", label, n)
+		}
+		out[i] = ep
+	}
+	return out
+}
 
-	fc, err := loadFileConfig(cfgPath)
+// HealthCheck describes how endpoints of a chain type are probed. An empty
+// Method falls back to a plain reachability check. HeightMethod returns the
+// endpoint's latest block (or slot); endpoints more than MaxBlockLag behind
+// the highest one on the chain are left out of rotation. A zero MaxBlockLag
+// disables lag detection.
+type HealthCheck struct {
+	Method       string        `yaml:"method"`
+	HeightMethod string        `yaml:"height_method"`
+	MaxBlockLag  uint64        `yaml:"max_block_lag"`
+	Interval     time.Duration `yaml:"interval"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Failures     int           `yaml:"failures"`  // consecutive failures before an endpoint is pulled
+	Successes    int           `yaml:"successes"` // consecutive successes before it is restored
+}
+
+var defaultHealthChecks = map[string]HealthCheck{
+	"evm":    {Method: "eth_blockNumber", HeightMethod: "eth_blockNumber", MaxBlockLag: 10},
+	"solana": {Method: "getHealth", HeightMethod: "getSlot", MaxBlockLag: 150},
+}
+
+// HealthCheckFor returns the health check settings for chain, merging the
+// config for its type over the built-in defaults.
+func (cm *ChainMap) HealthCheckFor(chain string) HealthCheck {
+	chainType := cm.ChainTypes[chain]
+
+	hc := defaultHealthChecks[chainType]
+	if override, ok := cm.HealthChecks[chainType]; ok {
+		if override.Method != "" {
+			hc.Method = override.Method
+		}
+		if override.HeightMethod != "" {
+			hc.HeightMethod = override.HeightMethod
+		}
+		if override.MaxBlockLag != 0 {
+			hc.MaxBlockLag = override.MaxBlockLag
+		}
+		hc.Interval = override.Interval
+		hc.Timeout = override.Timeout
+		hc.Failures = override.Failures
+		hc.Successes = override.Successes
+	}
+
+	if lag := cm.Chains[chain].MaxBlockLag; lag != 0 {
+		hc.MaxBlockLag = lag
+	}
+
+	if hc.Interval <= 0 {
+		hc.Interval = 15 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 5 * time.Second
+	}
+	if hc.Failures <= 0 {
+		hc.Failures = 2
+	}
+	if hc.Successes <= 0 {
+		hc.Successes = 1
+	}
+	return hc
+}
+
+// CircuitBreaker controls when an endpoint is skipped after failing. The
+// breaker opens after ConsecutiveFailures failures in a row, or when at least
+// MinRequests were seen in Window and the share of failures reaches
+// ErrorRate. It stays open for OpenFor, then lets HalfOpenRequests trial
+// requests through; a success closes it, a failure opens it again.
+type CircuitBreaker struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	ErrorRate           float64       `yaml:"error_rate"`
+	MinRequests         int           `yaml:"min_requests"`
+	Window              time.Duration `yaml:"window"`
+	OpenFor             time.Duration `yaml:"open_for"`
+	HalfOpenRequests    int           `yaml:"half_open_requests"`
+}
+
+// WithDefaults fills in unset circuit breaker settings
+func (cb CircuitBreaker) WithDefaults() CircuitBreaker {
+	if cb.ConsecutiveFailures <= 0 {
+		cb.ConsecutiveFailures = 5
+	}
+	if cb.ErrorRate <= 0 || cb.ErrorRate > 1 {
+		cb.ErrorRate = 0.5
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = 20
+	}
+	if cb.Window <= 0 {
+		cb.Window = 30 * time.Second
+	}
+	if cb.OpenFor <= 0 {
+		cb.OpenFor = 30 * time.Second
+	}
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = 1
+	}
+	return cb
+}
+
+// ResponseCache controls caching of JSON-RPC results. Rules maps a method
+// to how long its result may be served from the cache; methods without a rule
+// are always forwarded.
+type ResponseCache struct {
+	Enabled  bool                     `yaml:"enabled"`
+	MaxBytes int64                    `yaml:"max_bytes"`
+	Rules    map[string]time.Duration `yaml:"rules"`
+}
+
+// defaultCacheRules apply when response caching is enabled without rules.
+// Calls that reference latest, pending, safe or finalized are never cached.
+var defaultCacheRules = map[string]time.Duration{
+	"eth_chainId":               time.Hour,
+	"net_version":               time.Hour,
+	"eth_getBlockByHash":        time.Hour,
+	"eth_getBlockByNumber":      time.Minute,
+	"eth_getTransactionByHash":  5 * time.Minute,
+	"eth_getTransactionReceipt": 5 * time.Minute,
+	"getGenesisHash":            time.Hour,
+}
+
+// WithDefaults fills in unset response cache settings
+func (rc ResponseCache) WithDefaults() ResponseCache {
+	if rc.MaxBytes <= 0 {
+		rc.MaxBytes = 64 << 20
+	}
+	if len(rc.Rules) == 0 {
+		rc.Rules = defaultCacheRules
+	}
+	return rc
+}
+
+// LoadChainMap reads and validates the chain config at path and returns:
+// - HTTPEndpoints[chain]      = []httpURLs
+// - WebSocketEndpoints[chain] = []wsURLs
+// - ChainTypes[chain]         = type string
+func LoadChainMap(path string) (*ChainMap, error) {
+	fc, err := loadFileConfig(path)
 	if err != nil {
-		panic(fmt.Errorf("failed to load chain config: %w", err))
+		return nil, fmt.Errorf("failed to load chain config: %w", err)
 	}
 
-	httpEndpoints := make(map[string][]string, len(fc.Chains))
-	wsEndpoints := make(map[string][]string, len(fc.Chains))
-	chainTypes := make(map[string]string, len(fc.Chains))
+	cm := &ChainMap{
+		HTTPEndpoints:      make(map[string][]string, len(fc.Chains)),
+		WebSocketEndpoints: make(map[string][]string, len(fc.Chains)),
+		ChainTypes:         make(map[string]string, len(fc.Chains)),
+		Chains:             fc.Chains,
+		HealthChecks:       fc.HealthChecks,
+		CircuitBreaker:     fc.CircuitBreaker.WithDefaults(),
+		ResponseCache:      fc.ResponseCache.WithDefaults(),
+		JWT:                fc.JWT.WithDefaults(),
+	}
 
 	for chainName, chain := range fc.Chains {
-		chainTypes[chainName] = chain.Type
+		chain.HTTP = uniqueLabels(chain.HTTP)
+		chain.WS = uniqueLabels(chain.WS)
+		fc.Chains[chainName] = chain
+		cm.ChainTypes[chainName] = chain.Type
 
 		for _, ep := range chain.HTTP {
 			if ep.URL != "" {
-				httpEndpoints[chainName] = append(httpEndpoints[chainName], ep.URL)
+				cm.HTTPEndpoints[chainName] = append(cm.HTTPEndpoints[chainName], ep.URL)
 			}
 		}
 		for _, ep := range chain.WS {
 			if ep.URL != "" {
-				wsEndpoints[chainName] = append(wsEndpoints[chainName], ep.URL)
+				cm.WebSocketEndpoints[chainName] = append(cm.WebSocketEndpoints[chainName], ep.URL)
 			}
 		}
 	}
 
-	return httpEndpoints, wsEndpoints, chainTypes
+	return cm, nil
 }
 
 func loadFileConfig(path string) (*FileConfig, error) {
@@ -83,8 +499,118 @@ func loadFileConfig(path string) (*FileConfig, error) {
 	if err := yaml.Unmarshal(data, &fc); err != nil {
 		return nil, err
 	}
-	if len(fc.Chains) == 0 {
-		return nil, errors.New("no chains defined in config")
+	if err := fc.validate(); err != nil {
+		return nil, err
 	}
 	return &fc, nil
 }
+
+// validate rejects configs that would leave a chain without a usable upstream
+func (fc *FileConfig) validate() error {
+	if len(fc.Chains) == 0 {
+		return errors.New("no chains defined in config")
+	}
+	for method, ttl := range fc.ResponseCache.Rules {
+		if ttl < 0 {
+			return fmt.Errorf("response_cache: negative ttl for method %q", method)
+		}
+	}
+	issuers := map[string]bool{}
+	for _, iss := range fc.JWT.Issuers {
+		if iss.Issuer == "" || iss.JWKSFile == "" {
+			return errors.New("jwt: every issuer needs an issuer and a jwks_file")
+		}
+		if iss.Limit <= 0 {
+			return fmt.Errorf("jwt: issuer %q needs a positive limit", iss.Issuer)
+		}
+		if issuers[iss.Issuer] {
+			return fmt.Errorf("jwt: issuer %q is listed twice", iss.Issuer)
+		}
+		issuers[iss.Issuer] = true
+	}
+
+	for chainName, chain := range fc.Chains {
+		if chain.Balancer != "" && !slices.Contains(Balancers, chain.Balancer) {
+			return fmt.Errorf("chain %q: unknown balancer %q, expected one of %v", chainName, chain.Balancer, Balancers)
+		}
+		for method, cost := range chain.MethodCosts {
+			if cost < 0 {
+				return fmt.Errorf("chain %q: negative cost for method %q", chainName, method)
+			}
+		}
+		for _, pattern := range append(append([]string{}, chain.Methods.Allow...), chain.Methods.Deny...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("chain %q: invalid method pattern %q", chainName, pattern)
+			}
+		}
+
+		count := 0
+		for _, ep := range chain.HTTP {
+			if ep.URL == "" {
+				continue
+			}
+			if err := validateURL(ep.URL, "http", "https"); err != nil {
+				return fmt.Errorf("chain %q: %w", chainName, err)
+			}
+			count++
+		}
+		for _, ep := range chain.WS {
+			if ep.URL == "" {
+				continue
+			}
+			if err := validateURL(ep.URL, "ws", "wss"); err != nil {
+				return fmt.Errorf("chain %q: %w", chainName, err)
+			}
+			count++
+		}
+		if count == 0 {
+			return fmt.Errorf("chain %q has no endpoints", chainName)
+		}
+	}
+	return nil
+}
+
+func validateURL(raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint url: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("endpoint url %q has no host", u.Redacted())
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("endpoint url %q must use one of %v", u.Redacted(), schemes)
+}
+
+// JWT lists the issuers whose signed tokens are accepted in place of API
+// keys. Leeway is the clock skew allowed when checking exp and nbf.
+type JWT struct {
+	Issuers []JWTIssuer   `yaml:"issuers"`
+	Leeway  time.Duration `yaml:"leeway"`
+}
+
+// JWTIssuer trusts tokens whose iss claim is Issuer and whose signature
+// verifies with a key in JWKSFile. Org and OrgID, when set, replace the
+// token's claims so an issuer can only mint tokens for its own organisation.
+// Chains and Limit cap what its tokens may ask for.
+type JWTIssuer struct {
+	Issuer   string   `yaml:"issuer"`
+	Audience string   `yaml:"audience"` // required in aud, if set
+	JWKSFile string   `yaml:"jwks_file"`
+	Org      string   `yaml:"org"`
+	OrgID    string   `yaml:"org_id"`
+	Chains   []string `yaml:"chains"` // chains tokens may use, * or empty for all
+	Limit    int      `yaml:"limit"`  // largest limit a token may carry, and the default; required
+}
+
+// WithDefaults fills in unset JWT settings
+func (j JWT) WithDefaults() JWT {
+	if j.Leeway <= 0 {
+		j.Leeway = time.Minute
+	}
+	return j
+}
@@ -0,0 +1,82 @@
+package config
+
+import "testing"
+
+func TestMethodPolicyOverride(t *testing.T) {
+	chain := MethodPolicy{Deny: []string{"admin_*", "debug_*"}}
+
+	tests := []struct {
+		name    string
+		key     MethodPolicy
+		method  string
+		permits bool
+	}{
+		{"chain deny without key lists", MethodPolicy{}, "debug_traceTransaction", false},
+		{"chain deny kept when key denies others", MethodPolicy{Deny: []string{"eth_sendTransaction"}}, "admin_peers", false},
+		{"key deny added", MethodPolicy{Deny: []string{"eth_sendTransaction"}}, "eth_sendTransaction", false},
+		{"other methods still allowed", MethodPolicy{Deny: []string{"eth_sendTransaction"}}, "eth_call", true},
+		{"key allow narrows", MethodPolicy{Allow: []string{"eth_call"}}, "eth_blockNumber", false},
+		{"key allow cannot lift chain deny", MethodPolicy{Allow: []string{"debug_*"}}, "debug_traceTransaction", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chain.Override(tt.key).Permits(tt.method); got != tt.permits {
+				t.Errorf("Permits(%q) = %v, want %v", tt.method, got, tt.permits)
+			}
+		})
+	}
+
+	// A key cannot widen a chain's allow list, only narrow it
+	allowing := MethodPolicy{Allow: []string{"eth_*", "net_version"}}
+	allowTests := []struct {
+		name    string
+		key     MethodPolicy
+		method  string
+		permits bool
+	}{
+		{"chain allow without key lists", MethodPolicy{}, "eth_call", true},
+		{"chain allow refuses others", MethodPolicy{}, "debug_traceTransaction", false},
+		{"key allow outside chain allow", MethodPolicy{Allow: []string{"debug_*", "eth_call"}}, "debug_traceTransaction", false},
+		{"key allow wildcard", MethodPolicy{Allow: []string{"*"}}, "admin_peers", false},
+		{"key allow inside chain allow", MethodPolicy{Allow: []string{"debug_*", "eth_call"}}, "eth_call", true},
+		{"key allow narrows chain allow", MethodPolicy{Allow: []string{"eth_call"}}, "eth_blockNumber", false},
+	}
+	for _, tt := range allowTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowing.Override(tt.key).Permits(tt.method); got != tt.permits {
+				t.Errorf("Permits(%q) = %v, want %v", tt.method, got, tt.permits)
+			}
+		})
+	}
+
+	// Merging must not write into the chain's backing array
+	deny := make([]string, 1, 4)
+	deny[0] = "admin_*"
+	shared := MethodPolicy{Deny: deny}
+	first := shared.Override(MethodPolicy{Deny: []string{"a"}})
+	shared.Override(MethodPolicy{Deny: []string{"b"}})
+	if first.Deny[1] != "a" {
+		t.Errorf("first key's deny list changed to %v", first.Deny)
+	}
+}
+
+func TestValidateJWTIssuers(t *testing.T) {
+	chains := map[string]Chain{"ethereum": {HTTP: []Endpoint{{URL: "https://rpc.example.com"}}}}
+	tests := []struct {
+		name   string
+		issuer JWTIssuer
+		ok     bool
+	}{
+		{"complete", JWTIssuer{Issuer: "https://auth.example.com", JWKSFile: "jwks.json", Limit: 1000}, true},
+		{"no limit", JWTIssuer{Issuer: "https://auth.example.com", JWKSFile: "jwks.json"}, false},
+		{"negative limit", JWTIssuer{Issuer: "https://auth.example.com", JWKSFile: "jwks.json", Limit: -1}, false},
+		{"no jwks file", JWTIssuer{Issuer: "https://auth.example.com", Limit: 1000}, false},
+	}
+	for _, tt := range tests {
+		fc := FileConfig{Chains: chains, JWT: JWT{Issuers: []JWTIssuer{tt.issuer}}}
+		if err := fc.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v", tt.name, err)
+		}
+	}
+}
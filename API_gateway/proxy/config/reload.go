@@ -0,0 +1,118 @@
+package config
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"proxy/metrics"
+)
+
+// ChainStore holds the active chain map and swaps it atomically when the
+// config file changes. A config that fails validation never replaces the
+// current one.
+type ChainStore struct {
+	path    string
+	current atomic.Pointer[ChainMap]
+
+	mu        sync.Mutex // serialises reloads
+	modTime   time.Time
+	size      int64
+	listeners []func(*ChainMap)
+}
+
+// NewChainStore loads the initial chain map from path
+func NewChainStore(path string) (*ChainStore, error) {
+	s := &ChainStore{path: path}
+
+	cm, err := LoadChainMap(path)
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(cm)
+	s.modTime, s.size = s.stat()
+
+	return s, nil
+}
+
+// Current returns the chain map in effect. Callers should fetch it once per
+// request and not hold on to it.
+func (s *ChainStore) Current() *ChainMap {
+	return s.current.Load()
+}
+
+// OnReload registers fn to be called with every newly applied chain map
+func (s *ChainStore) OnReload(fn func(*ChainMap)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Reload re-reads the config file and swaps it in if it is valid
+func (s *ChainStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.modTime, s.size = s.stat()
+
+	cm, err := LoadChainMap(s.path)
+	if err != nil {
+		log.Printf("Config reload from %s failed, keeping previous chain map: %v", s.path, err)
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	s.current.Store(cm)
+	for _, fn := range s.listeners {
+		fn(cm)
+	}
+
+	log.Printf("Config reloaded from %s: %d chains", s.path, len(cm.ChainTypes))
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	metrics.ConfigLastReload.SetToCurrentTime()
+	return nil
+}
+
+// Watch polls the config file every interval and reloads it when it changes
+// or when the process receives SIGHUP. It blocks forever.
+func (s *ChainStore) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading config")
+			s.Reload()
+		case <-ticker.C:
+			if s.changed() {
+				s.Reload()
+			}
+		}
+	}
+}
+
+func (s *ChainStore) changed() bool {
+	modTime, size := s.stat()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !modTime.Equal(s.modTime) || size != s.size
+}
+
+// stat follows symlinks so ConfigMap-style atomic swaps are picked up
+func (s *ChainStore) stat() (time.Time, int64) {
+	info, err := os.Stat(filepath.Clean(s.path))
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// AllowsOrigin reports whether a browser origin such as https://app.example.com
+// may use the key. Patterns may start with a wildcard subdomain, e.g.
+// https://*.example.com. Keys without an origin allowlist allow any origin.
+func (k *KeyInfo) AllowsOrigin(origin string) bool {
+	return len(k.AllowedOrigins) == 0 || MatchOrigin(k.AllowedOrigins, origin)
+}
+
+// MatchOrigin reports whether origin matches one of the patterns, in the
+// format of allowed_origins. An empty list matches nothing.
+func MatchOrigin(patterns []string, origin string) bool {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, pattern := range patterns {
+		if wildcardMatch(strings.ToLower(strings.TrimSuffix(pattern, "/")), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether a client address is inside one of the key's CIDRs
+// or single addresses. Keys without an IP allowlist allow any address.
+func (k *KeyInfo) AllowsIP(ip netip.Addr) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, entry := range k.AllowedIPs {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			if prefix.Contains(ip) {
+				return true
+			}
+		} else if addr, err := netip.ParseAddr(entry); err == nil && addr.Unmap() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsUserAgent reports whether a User-Agent matches one of the key's
+// patterns, where * matches any run of characters. Matching ignores case.
+func (k *KeyInfo) AllowsUserAgent(userAgent string) bool {
+	if len(k.AllowedUserAgents) == 0 {
+		return true
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, pattern := range k.AllowedUserAgents {
+		if wildcardMatch(strings.ToLower(pattern), userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches s against pattern, where * stands for any run of
+// characters, including none
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
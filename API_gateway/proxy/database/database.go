@@ -5,22 +5,29 @@ import (
 
 	"database/sql"
 
-	"strconv"
+	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 
 	"proxy/config"
 )
 
 var db *sql.DB
 
-func InitDB() (*sql.DB, error) {
+func InitDB() (*sql.DB, Dialect, error) {
+	driver, sslMode := config.LoadDBDriver()
+	dialect, err := ParseDialect(driver)
+	if err != nil {
+		return nil, "", err
+	}
+
 	dbUser, dbPassword, dbHost, dbPort, dbDatabaseName := config.LoadDBConfig()
-	dsn := dbUser + ":" + dbPassword + "@tcp(" + dbHost + ":" + dbPort + ")/" + dbDatabaseName + "?parseTime=true"
+	dsn := dialect.DSN(dbUser, dbPassword, dbHost, dbPort, dbDatabaseName, sslMode)
 
-	db, err := sql.Open("mysql", dsn)
+	db, err := sql.Open(string(dialect), dsn)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Optional: tune pool settings
@@ -30,24 +37,19 @@ func InitDB() (*sql.DB, error) {
 
 	// Test connection
 	if err = db.Ping(); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return db, nil
+	return db, dialect, nil
 }
 
-func FetchAPIKeyInfo(db *sql.DB, apiKey string) (map[string]interface{}, error) {
-	query := "SELECT chain_name, org_name, `limit`, org_id FROM api_keys WHERE api_key = ?"
-	row := db.QueryRow(query, apiKey)
-
-	var chain, org string
-	var limit, orgID int
-	err := row.Scan(&chain, &org, &limit, &orgID)
-	if err != nil {
-		return nil, err
+// splitList parses a comma-separated column into its non-empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
 	}
-
-	return map[string]interface{}{
-		"chain": chain, "org": org, "limit": limit, "org_id": strconv.Itoa(orgID),
-	}, nil
-}
\ No newline at end of file
+	return out
+}
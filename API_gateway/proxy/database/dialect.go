@@ -0,0 +1,81 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Dialect papers over the SQL differences between the supported databases.
+// Queries are written with ? placeholders and passed through Rebind.
+type Dialect string
+
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+)
+
+// ParseDialect maps a DB_DRIVER value to its dialect
+func ParseDialect(driver string) (Dialect, error) {
+	switch driver {
+	case "", "mysql":
+		return MySQL, nil
+	case "postgres", "postgresql":
+		return Postgres, nil
+	}
+	return "", fmt.Errorf("unknown DB_DRIVER %q, expected mysql or postgres", driver)
+}
+
+// DSN builds the connection string for the dialect's driver
+func (d Dialect) DSN(user, password, host, port, name, sslMode string) string {
+	if d == Postgres {
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(user, password),
+			Host:   host + ":" + port,
+			Path:   "/" + name,
+		}
+		if sslMode != "" {
+			u.RawQuery = url.Values{"sslmode": {sslMode}}.Encode()
+		}
+		return u.String()
+	}
+	return user + ":" + password + "@tcp(" + host + ":" + port + ")/" + name + "?parseTime=true"
+}
+
+// Quote quotes an identifier that is a reserved word, such as limit
+func (d Dialect) Quote(ident string) string {
+	if d == Postgres {
+		return `"` + ident + `"`
+	}
+	return "`" + ident + "`"
+}
+
+// Rebind rewrites ? placeholders into the dialect's form. Queries must not
+// contain ? inside string literals.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Upsert returns the clause that turns an INSERT into an update of column,
+// adding the inserted value, when a row with the same key columns exists
+func (d Dialect) Upsert(table, column string, key ...string) string {
+	if d == Postgres {
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s = %s.%s + EXCLUDED.%s", strings.Join(key, ", "), column, table, column, column)
+	}
+	return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s = %s + VALUES(%s)", column, column, column)
+}
@@ -0,0 +1,81 @@
+package database
+
+import "testing"
+
+func TestParseDialect(t *testing.T) {
+	tests := []struct {
+		driver  string
+		dialect Dialect
+		ok      bool
+	}{
+		{"", MySQL, true},
+		{"mysql", MySQL, true},
+		{"postgres", Postgres, true},
+		{"postgresql", Postgres, true},
+		{"sqlite", "", false},
+	}
+	for _, tt := range tests {
+		d, err := ParseDialect(tt.driver)
+		if d != tt.dialect || (err == nil) != tt.ok {
+			t.Errorf("ParseDialect(%q) = %q, %v", tt.driver, d, err)
+		}
+	}
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := "SELECT a FROM t WHERE b = ? AND c IN (?, ?)"
+	if got := MySQL.Rebind(query); got != query {
+		t.Errorf("MySQL.Rebind = %q", got)
+	}
+	if got, want := Postgres.Rebind(query), "SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)"; got != want {
+		t.Errorf("Postgres.Rebind = %q, want %q", got, want)
+	}
+	if got := Postgres.Rebind("SELECT 1"); got != "SELECT 1" {
+		t.Errorf("Postgres.Rebind without placeholders = %q", got)
+	}
+}
+
+func TestDialectQuote(t *testing.T) {
+	if got := MySQL.Quote("limit"); got != "`limit`" {
+		t.Errorf("MySQL.Quote = %s", got)
+	}
+	if got := Postgres.Quote("limit"); got != `"limit"` {
+		t.Errorf("Postgres.Quote = %s", got)
+	}
+}
+
+func TestDialectUpsert(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{MySQL, "ON DUPLICATE KEY UPDATE requests = requests + VALUES(requests)"},
+		{Postgres, "ON CONFLICT (api_key, window_start) DO UPDATE SET requests = api_usage.requests + EXCLUDED.requests"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Upsert("api_usage", "requests", "api_key", "window_start"); got != tt.want {
+			t.Errorf("%s.Upsert = %q, want %q", tt.dialect, got, tt.want)
+		}
+	}
+}
+
+func TestDialectDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		sslMode string
+		want    string
+	}{
+		{"mysql", MySQL, "", "gw:p@ss@tcp(db:3306)/gateway?parseTime=true"},
+		{"mysql ignores sslmode", MySQL, "disable", "gw:p@ss@tcp(db:3306)/gateway?parseTime=true"},
+		{"postgres", Postgres, "", "postgres://gw:p%40ss@db:3306/gateway"},
+		{"postgres with sslmode", Postgres, "disable", "postgres://gw:p%40ss@db:3306/gateway?sslmode=disable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dialect.DSN("gw", "p@ss", "db", "3306", "gateway", tt.sslMode); got != tt.want {
+				t.Errorf("DSN = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// How API keys are matched against api_keys rows while hashed keys are rolled out
+const (
+	LookupPlaintext = "plaintext" // api_key holds the key
+	LookupBoth      = "both"      // either api_key_hash or api_key matches
+	LookupHashed    = "hashed"    // api_key_hash holds the key's hash
+)
+
+// KeyIDLength is the number of hex characters of the hash used as a key's ID
+const KeyIDLength = 16
+
+// KeyHasher derives the stored hash of an API key, HMAC-SHA256 with a server
+// secret, and its ID: a short prefix of the hash that is safe to use in
+// logs, metric labels and cache keys
+type KeyHasher struct {
+	secret []byte
+}
+
+func NewKeyHasher(secret string) *KeyHasher {
+	return &KeyHasher{secret: []byte(secret)}
+}
+
+// Hash returns the hex HMAC-SHA256 of apiKey. Without a secret it falls back
+// to a plain SHA-256, which is only used to derive IDs.
+func (h *KeyHasher) Hash(apiKey string) string {
+	if len(h.secret) == 0 {
+		sum := sha256.Sum256([]byte(apiKey))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(apiKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ID returns the public ID of apiKey
+func (h *KeyHasher) ID(apiKey string) string {
+	return h.Hash(apiKey)[:KeyIDLength]
+}
+
+// CheckLookupMode rejects unknown modes and hashed lookups without a secret
+func CheckLookupMode(mode string, hasher *KeyHasher) error {
+	switch mode {
+	case LookupPlaintext:
+		return nil
+	case LookupBoth, LookupHashed:
+		if len(hasher.secret) == 0 {
+			return fmt.Errorf("API_KEY_LOOKUP=%s requires API_KEY_HMAC_SECRET", mode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown API_KEY_LOOKUP %q, expected plaintext, both or hashed", mode)
+}
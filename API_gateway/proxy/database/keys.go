@@ -0,0 +1,268 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrKeyNotFound is returned by a KeyStore for keys it doesn't know
+var ErrKeyNotFound = errors.New("api key not found")
+
+// KeyInfo is everything the gateway knows about an API key
+type KeyInfo struct {
+	ID             string    `yaml:"-"` // public key ID, see KeyHasher
+	Chain          string    `yaml:"chain"`
+	Org            string    `yaml:"org"`
+	OrgID          string    `yaml:"org_id"`
+	Limit          int       `yaml:"limit"`
+	RPS            float64   `yaml:"rate_limit_rps"`
+	Burst          int       `yaml:"rate_limit_burst"`
+	QuotaPeriod    string    `yaml:"quota_period"`
+	BillingAnchor  time.Time `yaml:"billing_anchor"`
+	AllowedMethods []string  `yaml:"allowed_methods"`
+	DeniedMethods  []string  `yaml:"denied_methods"`
+	MaxBatchSize   int       `yaml:"max_batch_size"`
+	Enabled        bool      `yaml:"enabled"`
+	ExpiresAt      time.Time `yaml:"expires_at"` // zero for keys that don't expire
+	Plan           string    `yaml:"plan"`
+	AllowedChains  []string  `yaml:"allowed_chains"` // chains besides Chain the key may call, * for all
+	QuotaScope     string    `yaml:"quota_scope"`    // shared (default) or chain
+
+	// Client restrictions, empty for none
+	AllowedOrigins    []string `yaml:"allowed_origins"`     // e.g. https://app.example.com or https://*.example.com
+	AllowedIPs        []string `yaml:"allowed_ips"`         // CIDRs or single addresses
+	AllowedUserAgents []string `yaml:"allowed_user_agents"` // patterns where * matches anything
+}
+
+// Quota scopes of multi-chain keys
+const (
+	QuotaShared   = "shared"
+	QuotaPerChain = "chain"
+)
+
+// AllowsChain reports whether the key may call chain
+func (k *KeyInfo) AllowsChain(chain string) bool {
+	if chain == k.Chain {
+		return true
+	}
+	for _, c := range k.AllowedChains {
+		if c == "*" || c == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// UsageKey returns the key under which usage of chain counts against the
+// quota. Keys with a per-chain quota keep a separate count for every chain.
+func (k *KeyInfo) UsageKey(apiKey, chain string) string {
+	if k.QuotaScope == QuotaPerChain {
+		return apiKey + "|" + chain
+	}
+	return apiKey
+}
+
+// KeyStore looks up API keys
+type KeyStore interface {
+	// Get returns the key's info, or ErrKeyNotFound
+	Get(apiKey string) (*KeyInfo, error)
+}
+
+// KeyRevoker is implemented by stores that can disable a key
+type KeyRevoker interface {
+	Revoke(apiKey string) error
+}
+
+// KeyChange is the ID of a key and the time its row was last updated
+type KeyChange struct {
+	ID        string
+	UpdatedAt time.Time
+}
+
+// KeyWatcher is implemented by stores that can list the keys changed since a
+// point in time. ChangedSince returns the keys updated at or after since and
+// the time of the latest change; a zero since only returns the time. As
+// timestamps may be coarse, callers should expect to see a change again.
+type KeyWatcher interface {
+	ChangedSince(since time.Time) ([]KeyChange, time.Time, error)
+}
+
+// SQLKeyStore reads API keys from the api_keys table, matching them by
+// api_key, api_key_hash or either depending on the lookup mode
+type SQLKeyStore struct {
+	db      *sql.DB
+	dialect Dialect
+	hasher  *KeyHasher
+	mode    string
+}
+
+func NewSQLKeyStore(db *sql.DB, dialect Dialect, hasher *KeyHasher, mode string) *SQLKeyStore {
+	return &SQLKeyStore{db: db, dialect: dialect, hasher: hasher, mode: mode}
+}
+
+// match returns the WHERE condition selecting apiKey's row and its arguments
+func (s *SQLKeyStore) match(apiKey string) (string, []interface{}) {
+	switch s.mode {
+	case LookupHashed:
+		return "api_key_hash = ?", []interface{}{s.hasher.Hash(apiKey)}
+	case LookupBoth:
+		return "(api_key_hash = ? OR api_key = ?)", []interface{}{s.hasher.Hash(apiKey), apiKey}
+	}
+	return "api_key = ?", []interface{}{apiKey}
+}
+
+// keyColumns are the api_keys columns read by Get
+var keyColumns = []string{
+	"chain_name", "org_name", "limit", "org_id", "rate_limit_rps", "rate_limit_burst",
+	"quota_period", "billing_anchor", "allowed_methods", "denied_methods",
+	"max_batch_size", "enabled", "expires_at", "plan", "allowed_chains",
+	"quota_scope", "allowed_origins", "allowed_ips", "allowed_user_agents",
+}
+
+// CheckSchema returns an error naming the columns Get needs that api_keys
+// lacks, so a missing migration fails at startup instead of on every lookup
+func (s *SQLKeyStore) CheckSchema() error {
+	if err := s.probe("1"); err != nil {
+		return fmt.Errorf("reading api_keys: %w", err)
+	}
+
+	columns := append([]string{}, keyColumns...)
+	switch s.mode {
+	case LookupPlaintext:
+		columns = append(columns, "api_key")
+	case LookupHashed:
+		columns = append(columns, "api_key_hash")
+	case LookupBoth:
+		columns = append(columns, "api_key", "api_key_hash")
+	}
+
+	var missing []string
+	for _, column := range columns {
+		if s.probe(s.dialect.Quote(column)) != nil {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("api_keys is missing columns %s, see the README for the ALTER TABLE", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// HasColumn reports whether api_keys has the named column
+func (s *SQLKeyStore) HasColumn(column string) bool {
+	return s.probe(s.dialect.Quote(column)) == nil
+}
+
+// probe selects expr from api_keys without reading any row
+func (s *SQLKeyStore) probe(expr string) error {
+	rows, err := s.db.Query("SELECT " + expr + " FROM api_keys WHERE 1 = 0")
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func (s *SQLKeyStore) Get(apiKey string) (*KeyInfo, error) {
+	query := "SELECT chain_name, org_name, " + s.dialect.Quote("limit") + ", org_id, COALESCE(rate_limit_rps, 0), COALESCE(rate_limit_burst, 0), " +
+		"COALESCE(quota_period, ''), billing_anchor, COALESCE(allowed_methods, ''), COALESCE(denied_methods, ''), " +
+		"COALESCE(max_batch_size, 0), COALESCE(enabled, TRUE), expires_at, COALESCE(plan, ''), COALESCE(allowed_chains, ''), " +
+		"COALESCE(quota_scope, ''), COALESCE(allowed_origins, ''), COALESCE(allowed_ips, ''), COALESCE(allowed_user_agents, '') " +
+		"FROM api_keys WHERE "
+	where, args := s.match(apiKey)
+	row := s.db.QueryRow(s.dialect.Rebind(query+where), args...)
+
+	var key KeyInfo
+	var orgID int
+	var billingAnchor, expiresAt sql.NullTime
+	var allowedMethods, deniedMethods, allowedChains, allowedOrigins, allowedIPs, allowedUserAgents string
+	err := row.Scan(&key.Chain, &key.Org, &key.Limit, &orgID, &key.RPS, &key.Burst, &key.QuotaPeriod, &billingAnchor,
+		&allowedMethods, &deniedMethods, &key.MaxBatchSize, &key.Enabled, &expiresAt, &key.Plan, &allowedChains, &key.QuotaScope,
+		&allowedOrigins, &allowedIPs, &allowedUserAgents)
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key.OrgID = strconv.Itoa(orgID)
+	key.BillingAnchor = billingAnchor.Time
+	key.ExpiresAt = expiresAt.Time
+	key.AllowedMethods = splitList(allowedMethods)
+	key.DeniedMethods = splitList(deniedMethods)
+	key.AllowedChains = splitList(allowedChains)
+	key.AllowedOrigins = splitList(allowedOrigins)
+	key.AllowedIPs = splitList(allowedIPs)
+	key.AllowedUserAgents = splitList(allowedUserAgents)
+	return &key, nil
+}
+
+// Revoke disables the key and bumps its updated_at so other replicas drop it too
+func (s *SQLKeyStore) Revoke(apiKey string) error {
+	where, args := s.match(apiKey)
+
+	var exists int
+	err := s.db.QueryRow(s.dialect.Rebind("SELECT 1 FROM api_keys WHERE "+where), args...).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.dialect.Rebind("UPDATE api_keys SET enabled = FALSE, updated_at = CURRENT_TIMESTAMP WHERE "+where), args...)
+	return err
+}
+
+// ChangedSince lists the keys whose updated_at is at or after since. Rows
+// updated within the same second as since are returned again, as DATETIME
+// columns can't tell them apart from rows already seen.
+func (s *SQLKeyStore) ChangedSince(since time.Time) ([]KeyChange, time.Time, error) {
+	if since.IsZero() {
+		var latest sql.NullTime
+		if err := s.db.QueryRow("SELECT MAX(updated_at) FROM api_keys").Scan(&latest); err != nil {
+			return nil, since, err
+		}
+		return nil, latest.Time, nil
+	}
+
+	// Only read the key columns the lookup mode guarantees to exist
+	columns := "COALESCE(api_key, ''), ''"
+	switch s.mode {
+	case LookupHashed:
+		columns = "'', api_key_hash"
+	case LookupBoth:
+		columns = "COALESCE(api_key, ''), COALESCE(api_key_hash, '')"
+	}
+	rows, err := s.db.Query(s.dialect.Rebind("SELECT "+columns+", updated_at FROM api_keys WHERE updated_at >= ?"), since)
+	if err != nil {
+		return nil, since, err
+	}
+	defer rows.Close()
+
+	var keys []KeyChange
+	latest := since
+	for rows.Next() {
+		var apiKey, hash string
+		var updatedAt time.Time
+		if err := rows.Scan(&apiKey, &hash, &updatedAt); err != nil {
+			return nil, since, err
+		}
+		if len(hash) >= KeyIDLength {
+			keys = append(keys, KeyChange{ID: hash[:KeyIDLength], UpdatedAt: updatedAt})
+		} else if apiKey != "" {
+			keys = append(keys, KeyChange{ID: s.hasher.ID(apiKey), UpdatedAt: updatedAt})
+		}
+		if updatedAt.After(latest) {
+			latest = updatedAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, since, err
+	}
+	return keys, latest, nil
+}
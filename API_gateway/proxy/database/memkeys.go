@@ -0,0 +1,81 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MemoryKeyStore serves API keys from a fixed set, for tests and small
+// deployments without a database
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]*KeyInfo
+}
+
+func NewMemoryKeyStore(keys map[string]*KeyInfo) *MemoryKeyStore {
+	return &MemoryKeyStore{keys: keys}
+}
+
+// LoadFileKeyStore reads API keys from a YAML file mapping each key to its
+// settings. Keys are enabled unless the file says otherwise.
+func LoadFileKeyStore(path string) (*MemoryKeyStore, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to parse key file: %w", err)
+	}
+
+	keys := make(map[string]*KeyInfo, len(nodes))
+	for apiKey, node := range nodes {
+		key := &KeyInfo{Enabled: true}
+		if err := node.Decode(key); err != nil {
+			return nil, fmt.Errorf("key file entry %q: %w", apiKey, err)
+		}
+		keys[apiKey] = key
+	}
+	return NewMemoryKeyStore(keys), nil
+}
+
+// Keys returns the API keys in the store
+func (s *MemoryKeyStore) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.keys))
+	for apiKey := range s.keys {
+		keys = append(keys, apiKey)
+	}
+	return keys
+}
+
+func (s *MemoryKeyStore) Get(apiKey string) (*KeyInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[apiKey]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// Revoke disables the key until the store is loaded again
+func (s *MemoryKeyStore) Revoke(apiKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[apiKey]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	// Cached copies of the old info stay untouched
+	revoked := *key
+	revoked.Enabled = false
+	s.keys[apiKey] = &revoked
+	return nil
+}
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy/utils"
+)
+
+// SQLUsageStore shares quota usage between gateway replicas through the
+// api_usage table. Increments are counted locally and flushed in batches, and
+// each flush reads back the totals written by other replicas, so a key can
+// overshoot its quota by at most what the replicas accept in one interval.
+// A key's stored total is read before its first increment in the process, so
+// a restart doesn't hand out its quota again.
+type SQLUsageStore struct {
+	db      *sql.DB
+	dialect Dialect
+
+	mu      sync.Mutex
+	entries map[string]*sqlUsage
+
+	lastCleanup time.Time
+}
+
+type sqlUsage struct {
+	utils.APIUsage       // Count is synced + pending
+	synced         int64 // total across replicas at the last flush
+	pending        int64 // local increments not written yet
+}
+
+// NewSQLUsageStore starts a store that flushes to db every interval
+func NewSQLUsageStore(db *sql.DB, dialect Dialect, interval time.Duration) *SQLUsageStore {
+	s := &SQLUsageStore{db: db, dialect: dialect, entries: map[string]*sqlUsage{}}
+	go s.run(interval)
+	return s
+}
+
+func (s *SQLUsageStore) Increment(apiKey string, quota utils.Quota, n int64) (utils.APIUsage, bool) {
+	s.mu.Lock()
+	_, known := s.entries[apiKey]
+	s.mu.Unlock()
+	if !known {
+		s.load(apiKey, quota)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := utils.Now()
+
+	entry := s.entries[apiKey]
+	if entry == nil || !now.Before(entry.ResetAt) {
+		start, reset := quota.Window(now)
+		entry = &sqlUsage{APIUsage: utils.APIUsage{WindowStart: start.Truncate(time.Second), ResetAt: reset.Truncate(time.Second), LastUpdate: now}}
+		s.entries[apiKey] = entry
+	}
+
+	if !quota.Allows(&entry.APIUsage, n) {
+		return entry.APIUsage, false
+	}
+
+	entry.pending += n
+	entry.Count += n
+	entry.LastUpdate = now
+	return entry.APIUsage, true
+}
+
+// load starts apiKey's entry from the total stored for its active windows.
+// If the database can't be read the entry starts at 0 and catches up at the
+// next flush.
+func (s *SQLUsageStore) load(apiKey string, quota utils.Quota) {
+	now := utils.Now()
+	totals, err := s.read([]string{apiKey}, now)
+	if err != nil {
+		log.Printf("Error reading stored usage of API key %s: %v", apiKey, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another request for the key may have loaded it meanwhile
+	if s.entries[apiKey] != nil {
+		return
+	}
+	start, reset := quota.Window(now)
+	entry := &sqlUsage{APIUsage: utils.APIUsage{WindowStart: start.Truncate(time.Second), ResetAt: reset.Truncate(time.Second), LastUpdate: now}}
+	if total, ok := totals[apiKey]; ok {
+		if total.windowStart.Before(entry.WindowStart) {
+			entry.WindowStart, entry.ResetAt = total.windowStart, total.resetAt
+		}
+		entry.synced = total.count
+		entry.Count = total.count
+	}
+	s.entries[apiKey] = entry
+}
+
+func (s *SQLUsageStore) Delete(apiKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, apiKey)
+	for k := range s.entries {
+		if strings.HasPrefix(k, apiKey+"|") {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func (s *SQLUsageStore) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.flush(); err != nil {
+			log.Printf("Error flushing usage to database: %v", err)
+		}
+	}
+}
+
+type usageWindow struct {
+	apiKey      string
+	windowStart time.Time
+	resetAt     time.Time
+	count       int64
+}
+
+// flush writes pending increments and refreshes the totals of every active key
+func (s *SQLUsageStore) flush() error {
+	now := utils.Now()
+
+	// Take the pending counts, dropping keys whose window is over
+	s.mu.Lock()
+	var writes []usageWindow
+	keys := make([]string, 0, len(s.entries))
+	for apiKey, entry := range s.entries {
+		if entry.pending > 0 {
+			writes = append(writes, usageWindow{apiKey, entry.WindowStart, entry.ResetAt, entry.pending})
+			entry.pending = 0
+		}
+		if !now.Before(entry.ResetAt) {
+			delete(s.entries, apiKey)
+			continue
+		}
+		keys = append(keys, apiKey)
+	}
+	s.mu.Unlock()
+
+	if err := s.write(writes); err != nil {
+		// Put the counts back so they are retried on the next flush
+		s.mu.Lock()
+		for _, w := range writes {
+			if entry := s.entries[w.apiKey]; entry != nil && entry.WindowStart.Equal(w.windowStart) {
+				entry.pending += w.count
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	totals, err := s.read(keys, now)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for apiKey, total := range totals {
+		entry := s.entries[apiKey]
+		if entry == nil {
+			continue
+		}
+		// Rolling windows start on whichever replica saw the key first; adopt
+		// the earliest active window so every replica resets together
+		if total.windowStart.Before(entry.WindowStart) {
+			entry.WindowStart, entry.ResetAt = total.windowStart, total.resetAt
+		}
+		entry.synced = total.count
+		entry.Count = entry.synced + entry.pending
+	}
+	s.mu.Unlock()
+
+	if now.Sub(s.lastCleanup) > time.Hour {
+		s.lastCleanup = now
+		if _, err := s.db.Exec(s.dialect.Rebind("DELETE FROM api_usage WHERE reset_at < ?"), now.Add(-24*time.Hour)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLUsageStore) write(writes []usageWindow) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(s.dialect.Rebind("INSERT INTO api_usage (api_key, window_start, reset_at, requests) VALUES (?, ?, ?, ?) " +
+		s.dialect.Upsert("api_usage", "requests", "api_key", "window_start")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, w := range writes {
+		if _, err := stmt.Exec(w.apiKey, w.windowStart, w.resetAt, w.count); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// read sums the requests of each key's active windows and returns the
+// earliest active window per key
+func (s *SQLUsageStore) read(keys []string, now time.Time) (map[string]usageWindow, error) {
+	totals := make(map[string]usageWindow, len(keys))
+
+	// Keep the IN list to a sane size
+	const batchSize = 500
+	for len(keys) > 0 {
+		batch := keys[:min(batchSize, len(keys))]
+		keys = keys[len(batch):]
+
+		args := make([]interface{}, 0, len(batch)+1)
+		for _, k := range batch {
+			args = append(args, k)
+		}
+		args = append(args, now)
+
+		query := "SELECT api_key, window_start, reset_at, requests FROM api_usage WHERE api_key IN (?" +
+			strings.Repeat(", ?", len(batch)-1) + ") AND reset_at > ?"
+		rows, err := s.db.Query(s.dialect.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var w usageWindow
+			if err := rows.Scan(&w.apiKey, &w.windowStart, &w.resetAt, &w.count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			total, seen := totals[w.apiKey]
+			if seen {
+				w.count += total.count
+				if total.windowStart.Before(w.windowStart) {
+					w.windowStart, w.resetAt = total.windowStart, total.resetAt
+				}
+			}
+			totals[w.apiKey] = w
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+	}
+	return totals, nil
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+
+	"proxy/database"
+)
+
+// requestOrigin returns the Origin of a request, falling back to the origin
+// of its Referer for clients that only send the latter
+func requestOrigin(ctx *fasthttp.RequestCtx) string {
+	if origin := string(ctx.Request.Header.Peek("Origin")); origin != "" {
+		return origin
+	}
+	referer, err := url.Parse(string(ctx.Request.Header.Peek("Referer")))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return referer.Scheme + "://" + referer.Host
+}
+
+// clientIP returns the address of the client. Behind trustedHops proxies
+// that each append the address they received from to X-Forwarded-For, the
+// client is the trustedHops-th entry from the right; entries further left
+// were sent by the client and can be forged. If the header has fewer
+// entries, the connection's address is used.
+func clientIP(ctx *fasthttp.RequestCtx, trustedHops int) netip.Addr {
+	if trustedHops > 0 {
+		var hops []string
+		for _, header := range ctx.Request.Header.PeekAll("X-Forwarded-For") {
+			hops = append(hops, strings.Split(string(header), ",")...)
+		}
+		if len(hops) >= trustedHops {
+			if ip, err := netip.ParseAddr(strings.TrimSpace(hops[len(hops)-trustedHops])); err == nil {
+				return ip
+			}
+		}
+	}
+	ip, _ := netip.AddrFromSlice(ctx.RemoteIP())
+	return ip
+}
+
+// checkAccess enforces the key's origin, IP and User-Agent allowlists. It
+// returns a message for the client if the request is refused.
+func checkAccess(ctx *fasthttp.RequestCtx, key *database.KeyInfo, trustedHops int) string {
+	if len(key.AllowedOrigins) > 0 && !key.AllowsOrigin(requestOrigin(ctx)) {
+		return "Origin not allowed for this API key"
+	}
+	if !key.AllowsIP(clientIP(ctx, trustedHops)) {
+		return "IP address not allowed for this API key"
+	}
+	if !key.AllowsUserAgent(string(ctx.Request.Header.UserAgent())) {
+		return "User-Agent not allowed for this API key"
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		forwarded   []string // X-Forwarded-For headers, in order
+		trustedHops int
+		ip          string
+	}{
+		{"no trusted proxy ignores the header", []string{"198.51.100.7"}, 0, "10.0.0.2"},
+		{"one hop uses the right-most entry", []string{"203.0.113.9, 198.51.100.7"}, 1, "198.51.100.7"},
+		{"forged left-most entry is ignored", []string{"1.2.3.4, 198.51.100.7"}, 1, "198.51.100.7"},
+		{"two hops", []string{"1.2.3.4, 198.51.100.7, 10.0.0.9"}, 2, "198.51.100.7"},
+		{"repeated headers are joined", []string{"1.2.3.4", "198.51.100.7, 10.0.0.9"}, 2, "198.51.100.7"},
+		{"fewer entries than hops", []string{"198.51.100.7"}, 2, "10.0.0.2"},
+		{"missing header", nil, 1, "10.0.0.2"},
+		{"unparsable entry", []string{"unknown"}, 1, "10.0.0.2"},
+		{"IPv6 entry", []string{"2001:db8::1"}, 1, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req fasthttp.Request
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(&req, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}, nil)
+
+			if got := clientIP(ctx, tt.trustedHops).Unmap(); got != netip.MustParseAddr(tt.ip) {
+				t.Errorf("clientIP = %s, want %s", got, tt.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"proxy/database"
+	"proxy/metrics"
+	"proxy/utils"
+)
+
+// keyCacheTTL is how long key data is used before it is read again
+const keyCacheTTL = 6 * time.Hour
+
+// staleRetryInterval spaces out background refreshes of a key that is being
+// served stale
+const staleRetryInterval = 10 * time.Second
+
+// invalidKey is cached in place of key data for keys the database doesn't
+// know, so a client retrying a bad key doesn't cost a query per request
+type invalidKey struct{}
+
+// cachedKey is key data along with the time it is due for a refresh. It
+// stays in the cache for the stale grace period after that.
+type cachedKey struct {
+	data    *database.KeyInfo
+	expires time.Time
+}
+
+// KeyLookup resolves API keys through apiCache, loading misses from the
+// database once per key no matter how many requests are waiting on it.
+// Entries are cached under the key's ID rather than the key itself.
+type KeyLookup struct {
+	cache       *cache.Cache
+	store       database.KeyStore
+	hasher      *database.KeyHasher
+	usageStore  utils.UsageStore
+	negativeTTL time.Duration
+	staleGrace  time.Duration
+	inflight    utils.Group[*database.KeyInfo]
+
+	mu    sync.Mutex
+	stale map[string]time.Time // IDs of keys served stale, and when to retry the database
+}
+
+func NewKeyLookup(apiCache *cache.Cache, store database.KeyStore, hasher *database.KeyHasher, usageStore utils.UsageStore, negativeTTL, staleGrace time.Duration) *KeyLookup {
+	k := &KeyLookup{
+		cache:       apiCache,
+		store:       store,
+		hasher:      hasher,
+		usageStore:  usageStore,
+		negativeTTL: negativeTTL,
+		staleGrace:  staleGrace,
+		stale:       make(map[string]time.Time),
+	}
+	// A stale entry that runs out of grace is no longer served
+	apiCache.OnEvicted(func(id string, _ interface{}) { k.setStale(id, false) })
+	return k
+}
+
+// lookup returns the info of apiKey, or database.ErrKeyNotFound if the key
+// is unknown. Expired key data is served for up to the stale grace period
+// while the database can't be reached.
+func (k *KeyLookup) lookup(apiKey string) (*database.KeyInfo, error) {
+	id := k.hasher.ID(apiKey)
+	entry, found := k.cache.Get(id)
+	if !found {
+		return k.fetch(id, apiKey)
+	}
+
+	switch entry := entry.(type) {
+	case invalidKey:
+		metrics.MetricAPICache.WithLabelValues("NEGATIVE_HIT").Inc()
+		return nil, database.ErrKeyNotFound
+	case *cachedKey:
+		if utils.Now().Before(entry.expires) {
+			metrics.MetricAPICache.WithLabelValues("HIT").Inc()
+			return entry.data, nil
+		}
+		// The database already failed for this key; don't make every request wait on it
+		if stale, due := k.staleState(id); stale {
+			if due {
+				go k.refresh(id, apiKey)
+			}
+			metrics.MetricAPICache.WithLabelValues("STALE_HIT").Inc()
+			return entry.data, nil
+		}
+
+		key, err := k.fetch(id, apiKey)
+		if err == nil || err == database.ErrKeyNotFound {
+			return key, err
+		}
+		log.Printf("Serving stale data for API key %s: %v", id, err)
+		k.setStale(id, true)
+		metrics.MetricAPICache.WithLabelValues("STALE_HIT").Inc()
+		return entry.data, nil
+	}
+	return k.fetch(id, apiKey)
+}
+
+// fetch loads apiKey from the database and caches the outcome under id.
+// Database errors are not cached.
+func (k *KeyLookup) fetch(id, apiKey string) (*database.KeyInfo, error) {
+	key, err, joined := k.inflight.Do(id, func() (*database.KeyInfo, error) {
+		metrics.MetricAPICache.WithLabelValues("DB_LOOKUP").Inc()
+		stored, err := k.store.Get(apiKey)
+		switch {
+		case err == database.ErrKeyNotFound:
+			metrics.MetricAPICache.WithLabelValues("INVALID").Inc()
+			k.cache.Set(id, invalidKey{}, k.negativeTTL)
+			k.setStale(id, false)
+			return nil, err
+		case err != nil:
+			return nil, err
+		}
+
+		// Copy so the store's own value is never modified
+		key := *stored
+		key.ID = id
+		k.cache.Set(id, &cachedKey{data: &key, expires: utils.Now().Add(keyCacheTTL)}, keyCacheTTL+k.staleGrace)
+		k.setStale(id, false)
+		return &key, nil
+	})
+	if joined {
+		metrics.MetricAPICache.WithLabelValues("SHARED_LOOKUP").Inc()
+	}
+	return key, err
+}
+
+// refresh retries the database for a key that is being served stale
+func (k *KeyLookup) refresh(id, apiKey string) {
+	if _, err := k.fetch(id, apiKey); err != nil && err != database.ErrKeyNotFound {
+		log.Printf("Refreshing stale API key %s failed: %v", id, err)
+	}
+}
+
+// staleState reports whether apiKey is being served stale and, if so,
+// whether a refresh is due. A due refresh is claimed by the caller.
+func (k *KeyLookup) staleState(id string) (stale, due bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	retryAt, stale := k.stale[id]
+	if stale && utils.Now().After(retryAt) {
+		k.stale[id] = utils.Now().Add(staleRetryInterval)
+		return true, true
+	}
+	return stale, false
+}
+
+func (k *KeyLookup) setStale(id string, stale bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if stale {
+		k.stale[id] = utils.Now().Add(staleRetryInterval)
+	} else {
+		delete(k.stale, id)
+	}
+	metrics.StaleAPIKeys.Set(float64(len(k.stale)))
+}
+
+// Evict drops apiKey from the key cache, so the next request reads the key
+// from the store again
+func (k *KeyLookup) Evict(apiKey string) {
+	k.cache.Delete(k.hasher.ID(apiKey))
+}
+
+// Revoke disables apiKey in the key store, evicts it and forgets its quota
+// usage
+func (k *KeyLookup) Revoke(apiKey string) error {
+	revoker, ok := k.store.(database.KeyRevoker)
+	if !ok {
+		return errors.New("key store does not support revocation")
+	}
+	if err := revoker.Revoke(apiKey); err != nil {
+		return err
+	}
+	k.Evict(apiKey)
+	k.usageStore.Delete(k.hasher.ID(apiKey))
+	return nil
+}
+
+// changeOverlap is how far before the latest change seen the key store is
+// polled again, so rows updated in the same second, or committed late by a
+// slow transaction, are not missed
+const changeOverlap = 5 * time.Second
+
+// WatchChanges polls the key store every interval and drops keys updated
+// since the last poll from the key cache and the usage store. Stores that
+// can't list changes are not polled.
+func (k *KeyLookup) WatchChanges(interval time.Duration) {
+	watcher, ok := k.store.(database.KeyWatcher)
+	if !ok {
+		return
+	}
+
+	var since time.Time
+	seen := make(map[keyChange]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		from := since
+		if !since.IsZero() {
+			from = since.Add(-changeOverlap)
+		}
+		changes, latest, err := watcher.ChangedSince(from)
+		if err != nil {
+			log.Printf("Error polling API key changes: %v", err)
+			continue
+		}
+		if dropped := k.dropChanges(changes, latest, seen); dropped > 0 {
+			log.Printf("Dropped %d changed API keys from the cache", dropped)
+		}
+		since = latest
+	}
+}
+
+// keyChange identifies one update of a key, to tell it apart from updates
+// already handled by an earlier, overlapping poll
+type keyChange struct {
+	id        string
+	updatedAt int64 // Unix nanoseconds
+}
+
+// dropChanges evicts the keys of changes not in seen and returns how many
+// it evicted. seen only keeps the changes within the overlap of latest.
+func (k *KeyLookup) dropChanges(changes []database.KeyChange, latest time.Time, seen map[keyChange]bool) int {
+	dropped := 0
+	for _, c := range changes {
+		change := keyChange{c.ID, c.UpdatedAt.UnixNano()}
+		if seen[change] {
+			continue
+		}
+		seen[change] = true
+		k.cache.Delete(c.ID)
+		k.usageStore.Delete(c.ID)
+		dropped++
+	}
+	horizon := latest.Add(-changeOverlap).UnixNano()
+	for change := range seen {
+		if change.updatedAt < horizon {
+			delete(seen, change)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"proxy/database"
+	"proxy/utils"
+)
+
+// fakeKeyStore serves keys from a map, counting calls to Get. Get fails
+// with err while it is set and waits for release to close while it is set.
+type fakeKeyStore struct {
+	mu      sync.Mutex
+	keys    map[string]*database.KeyInfo
+	err     error
+	release chan struct{}
+	calls   atomic.Int64
+}
+
+func (s *fakeKeyStore) Get(apiKey string) (*database.KeyInfo, error) {
+	s.calls.Add(1)
+	s.mu.Lock()
+	release := s.release
+	s.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	key, ok := s.keys[apiKey]
+	if !ok {
+		return nil, database.ErrKeyNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (s *fakeKeyStore) set(apiKey string, key *database.KeyInfo, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key != nil {
+		s.keys[apiKey] = key
+	}
+	s.err = err
+}
+
+func newTestLookup(store *fakeKeyStore, staleGrace time.Duration) *KeyLookup {
+	usage := utils.NewMemoryUsageStore(cache.New(time.Hour, time.Hour), &sync.Map{})
+	return NewKeyLookup(cache.New(time.Hour, time.Hour), store, database.NewKeyHasher(""), usage, time.Minute, staleGrace)
+}
+
+var errStoreDown = errors.New("database is down")
+
+func TestKeyLookupCachesUnknownKeys(t *testing.T) {
+	store := &fakeKeyStore{keys: map[string]*database.KeyInfo{}}
+	k := newTestLookup(store, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := k.lookup("unknown"); err != database.ErrKeyNotFound {
+			t.Fatalf("lookup %d error = %v, want ErrKeyNotFound", i, err)
+		}
+	}
+	if n := store.calls.Load(); n != 1 {
+		t.Errorf("store called %d times for an unknown key, want 1", n)
+	}
+
+	// The negative entry lives for the negative TTL only
+	_, expires, found := k.cache.GetWithExpiration(k.hasher.ID("unknown"))
+	if !found || expires.After(time.Now().Add(time.Minute)) || expires.Before(time.Now().Add(50*time.Second)) {
+		t.Errorf("negative entry expires at %v, want in about a minute", expires)
+	}
+
+	// A key created later is found once the negative entry is gone
+	store.set("unknown", &database.KeyInfo{Chain: "ethereum"}, nil)
+	k.cache.Delete(k.hasher.ID("unknown"))
+	if key, err := k.lookup("unknown"); err != nil || key.Chain != "ethereum" {
+		t.Errorf("lookup after the negative entry expired = %v, %v", key, err)
+	}
+}
+
+func TestKeyLookupDoesNotCacheErrors(t *testing.T) {
+	store := &fakeKeyStore{keys: map[string]*database.KeyInfo{"k": {Chain: "ethereum"}}}
+	store.set("", nil, errStoreDown)
+	k := newTestLookup(store, 0)
+
+	if _, err := k.lookup("k"); err != errStoreDown {
+		t.Fatalf("lookup error = %v, want the store's", err)
+	}
+	store.set("", nil, nil)
+	if key, err := k.lookup("k"); err != nil || key.Chain != "ethereum" {
+		t.Errorf("lookup after the store recovered = %v, %v", key, err)
+	}
+	if n := store.calls.Load(); n != 2 {
+		t.Errorf("store called %d times, want 2", n)
+	}
+}
+
+func TestKeyLookupCoalescesFetches(t *testing.T) {
+	store := &fakeKeyStore{keys: map[string]*database.KeyInfo{"k": {Chain: "ethereum"}}, release: make(chan struct{})}
+	k := newTestLookup(store, 0)
+
+	const callers = 20
+	var wg sync.WaitGroup
+	results := make([]*database.KeyInfo, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := k.lookup("k")
+			if err != nil {
+				t.Errorf("lookup error = %v", err)
+			}
+			results[i] = key
+		}()
+	}
+	// Give every caller time to queue up behind the first fetch
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	if n := store.calls.Load(); n != 1 {
+		t.Errorf("store called %d times by %d concurrent lookups, want 1", n, callers)
+	}
+	for i, key := range results {
+		if key == nil || key.Chain != "ethereum" || key.ID != k.hasher.ID("k") {
+			t.Errorf("caller %d got %+v", i, key)
+		}
+	}
+}
+
+func TestKeyLookupServesStale(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	utils.Now = func() time.Time { return now }
+	t.Cleanup(func() { utils.Now = time.Now })
+
+	store := &fakeKeyStore{keys: map[string]*database.KeyInfo{"k": {Chain: "ethereum", Plan: "free"}}}
+	k := newTestLookup(store, time.Hour)
+	id := k.hasher.ID("k")
+	plan := func() string {
+		t.Helper()
+		key, err := k.lookup("k")
+		if err != nil {
+			t.Fatalf("lookup error = %v", err)
+		}
+		return key.Plan
+	}
+	// waitForCalls waits for background refreshes to reach the store
+	waitForCalls := func(n int64) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); store.calls.Load() < n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("store called %d times, want %d", store.calls.Load(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	plan()
+	if n := store.calls.Load(); n != 1 {
+		t.Fatalf("store called %d times, want 1", n)
+	}
+
+	// Once the data is due for a refresh and the store is down, the old data
+	// is served and the key is marked stale
+	store.set("", nil, errStoreDown)
+	now = now.Add(keyCacheTTL)
+	if got := plan(); got != "free" {
+		t.Fatalf("plan = %s, want the stale free", got)
+	}
+	if stale, _ := k.staleState(id); !stale || store.calls.Load() != 2 {
+		t.Fatalf("stale %v after %d calls; want stale after 2", stale, store.calls.Load())
+	}
+
+	// Requests served stale don't wait on the store until a retry is due
+	plan()
+	if n := store.calls.Load(); n != 2 {
+		t.Errorf("store called %d times before the retry was due, want 2", n)
+	}
+	now = now.Add(staleRetryInterval + time.Second)
+	if got := plan(); got != "free" {
+		t.Errorf("plan = %s, want the stale free", got)
+	}
+	waitForCalls(3)
+
+	// A refresh after the store recovers replaces the stale data
+	store.set("k", &database.KeyInfo{Chain: "ethereum", Plan: "pro"}, nil)
+	now = now.Add(staleRetryInterval + time.Second)
+	plan()
+	waitForCalls(4)
+	for deadline := time.Now().Add(time.Second); plan() != "pro"; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed data never served")
+		}
+	}
+	if stale, _ := k.staleState(id); stale {
+		t.Error("key still marked stale after a successful refresh")
+	}
+}
+
+func TestKeyLookupStaleKeyDeleted(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	utils.Now = func() time.Time { return now }
+	t.Cleanup(func() { utils.Now = time.Now })
+
+	store := &fakeKeyStore{keys: map[string]*database.KeyInfo{"k": {Chain: "ethereum"}}}
+	k := newTestLookup(store, time.Hour)
+	if _, err := k.lookup("k"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key removed from the store is not served stale
+	store.mu.Lock()
+	delete(store.keys, "k")
+	store.mu.Unlock()
+	now = now.Add(keyCacheTTL)
+	if _, err := k.lookup("k"); err != database.ErrKeyNotFound {
+		t.Errorf("lookup error = %v, want ErrKeyNotFound", err)
+	}
+
+	// Nor is an expired entry once the stale grace is used up
+	store.set("k2", &database.KeyInfo{Chain: "ethereum"}, nil)
+	if _, err := k.lookup("k2"); err != nil {
+		t.Fatal(err)
+	}
+	_, expires, _ := k.cache.GetWithExpiration(k.hasher.ID("k2"))
+	if want := time.Now().Add(keyCacheTTL + time.Hour); expires.Before(want.Add(-time.Minute)) || expires.After(want) {
+		t.Errorf("entry expires at %v, want after the TTL and the stale grace, about %v", expires, want)
+	}
+}
+
+func TestDropChanges(t *testing.T) {
+	apiCache := cache.New(time.Hour, time.Hour)
+	usage := utils.NewMemoryUsageStore(cache.New(time.Hour, time.Hour), &sync.Map{})
+	k := NewKeyLookup(apiCache, nil, database.NewKeyHasher(""), usage, time.Minute, 0)
+	cached := func(id string) {
+		apiCache.Set(id, &cachedKey{data: &database.KeyInfo{ID: id}}, time.Hour)
+		usage.Increment(id, utils.Quota{Limit: 10}, 1)
+	}
+
+	t0 := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	seen := make(map[keyChange]bool)
+
+	// Both keys changed in the same second
+	cached("a")
+	cached("b")
+	if n := k.dropChanges([]database.KeyChange{{ID: "a", UpdatedAt: t0}, {ID: "b", UpdatedAt: t0}}, t0, seen); n != 2 {
+		t.Fatalf("first poll dropped %d keys, want 2", n)
+	}
+	if _, found := apiCache.Get("a"); found {
+		t.Error("changed key still cached")
+	}
+	if u, _ := usage.Increment("a", utils.Quota{Limit: 10}, 0); u.Count != 0 {
+		t.Errorf("changed key's usage = %d, want it forgotten", u.Count)
+	}
+
+	// The next poll overlaps the first: the same updates are not dropped
+	// again, a later one of the same key is
+	cached("a")
+	cached("b")
+	t1 := t0.Add(time.Second)
+	if n := k.dropChanges([]database.KeyChange{{ID: "a", UpdatedAt: t0}, {ID: "b", UpdatedAt: t0}, {ID: "b", UpdatedAt: t1}}, t1, seen); n != 1 {
+		t.Fatalf("overlapping poll dropped %d keys, want 1", n)
+	}
+	if _, found := apiCache.Get("a"); !found {
+		t.Error("key dropped again for an update already handled")
+	}
+	if _, found := apiCache.Get("b"); found {
+		t.Error("key not dropped for a new update")
+	}
+
+	// Updates older than the overlap are forgotten
+	k.dropChanges(nil, t1.Add(time.Minute), seen)
+	if len(seen) != 0 {
+		t.Errorf("seen = %v, want it pruned", seen)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"proxy/database"
+)
+
+const corsAllowedMethods = "GET, POST, PUT, DELETE, OPTIONS"
+
+// corsExposedHeaders are the response headers browsers let scripts read on
+// top of the safelisted ones, so clients can back off on their quota
+const corsExposedHeaders = "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After"
+
+// corsPolicy holds the CORS settings shared by every key
+type corsPolicy struct {
+	allowedHeaders    string
+	maxAge            string // seconds
+	allowCredentials  bool
+	credentialOrigins []string
+}
+
+// newCORSPolicy refuses credentialed CORS without an explicit list of the
+// origins allowed to use it, since any other site could then make requests
+// that carry the user's cookies
+func newCORSPolicy(allowedHeaders string, maxAge time.Duration, allowCredentials bool, credentialOrigins []string) (*corsPolicy, error) {
+	if allowCredentials && len(credentialOrigins) == 0 {
+		return nil, errors.New("CORS_ALLOW_CREDENTIALS requires CORS_CREDENTIAL_ORIGINS")
+	}
+	if slices.Contains(credentialOrigins, "*") {
+		return nil, errors.New("CORS_CREDENTIAL_ORIGINS must list origins, not *")
+	}
+	return &corsPolicy{
+		allowedHeaders:    allowedHeaders,
+		maxAge:            strconv.Itoa(int(maxAge.Seconds())),
+		allowCredentials:  allowCredentials,
+		credentialOrigins: credentialOrigins,
+	}, nil
+}
+
+// preflight answers an OPTIONS request without looking at its API key, so it
+// costs no quota and never reaches an upstream. The key's origin allowlist is
+// still enforced on the actual request.
+func (c *corsPolicy) preflight(ctx *fasthttp.RequestCtx) {
+	c.setOrigin(ctx, nil)
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	ctx.Response.Header.Set("Access-Control-Allow-Headers", c.allowedHeaders)
+	ctx.Response.Header.Set("Access-Control-Max-Age", c.maxAge)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// setHeaders adds the CORS headers to the response of a request made with
+// key, or with nil while the key is not known yet. Calling it again once the
+// key is known replaces the origin set before.
+func (c *corsPolicy) setHeaders(ctx *fasthttp.RequestCtx, key *database.KeyInfo) {
+	c.setOrigin(ctx, key)
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	ctx.Response.Header.Set("Access-Control-Allow-Headers", c.allowedHeaders)
+	ctx.Response.Header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+}
+
+// setOrigin sets Access-Control-Allow-Origin. Origins in the credential
+// allowlist, and for keys with an origin allowlist the origins it allows,
+// get the request's origin reflected, as browsers reject the wildcard for
+// credentialed requests; everything else gets *.
+func (c *corsPolicy) setOrigin(ctx *fasthttp.RequestCtx, key *database.KeyInfo) {
+	ctx.Response.Header.Del("Access-Control-Allow-Origin")
+	ctx.Response.Header.Del("Access-Control-Allow-Credentials")
+	restricted := key != nil && len(key.AllowedOrigins) > 0
+	if !restricted && !c.allowCredentials {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	if !variesOnOrigin(ctx) {
+		ctx.Response.Header.Add("Vary", "Origin")
+	}
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	if restricted && (origin == "" || !key.AllowsOrigin(origin)) {
+		return
+	}
+	credentialed := c.allowCredentials && origin != "" && database.MatchOrigin(c.credentialOrigins, origin)
+	if !restricted && !credentialed {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+	if credentialed {
+		ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// variesOnOrigin reports whether the response already has Vary: Origin
+func variesOnOrigin(ctx *fasthttp.RequestCtx) bool {
+	for _, v := range ctx.Response.Header.PeekAll("Vary") {
+		if string(v) == "Origin" {
+			return true
+		}
+	}
+	return false
+}
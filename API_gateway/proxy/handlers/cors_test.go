@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"proxy/database"
+)
+
+func TestNewCORSPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials bool
+		origins     []string
+		ok          bool
+	}{
+		{"no credentials", false, nil, true},
+		{"credentials with origins", true, []string{"https://app.example.com"}, true},
+		{"credentials without origins", true, nil, false},
+		{"wildcard origin", true, []string{"*"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := newCORSPolicy("Content-Type", time.Minute, tt.credentials, tt.origins); (err == nil) != tt.ok {
+			t.Errorf("%s: newCORSPolicy error %v", tt.name, err)
+		}
+	}
+}
+
+func TestCORSSetOrigin(t *testing.T) {
+	open, _ := newCORSPolicy("Content-Type", time.Minute, false, nil)
+	credentialed, _ := newCORSPolicy("Content-Type", time.Minute, true, []string{"https://*.example.com"})
+	restricted := &database.KeyInfo{AllowedOrigins: []string{"https://app.example.com", "https://other.org"}}
+
+	tests := []struct {
+		name        string
+		policy      *corsPolicy
+		key         *database.KeyInfo
+		origin      string
+		allowOrigin string
+		credentials bool
+	}{
+		{"open policy", open, nil, "https://evil.org", "*", false},
+		{"open policy, restricted key", open, restricted, "https://other.org", "https://other.org", false},
+		{"open policy, origin refused by key", open, restricted, "https://evil.org", "", false},
+		{"listed origin gets credentials", credentialed, nil, "https://app.example.com", "https://app.example.com", true},
+		{"unlisted origin gets no credentials", credentialed, nil, "https://evil.org", "*", false},
+		{"preflight without origin", credentialed, nil, "", "*", false},
+		{"restricted key, listed origin", credentialed, restricted, "https://app.example.com", "https://app.example.com", true},
+		{"restricted key, unlisted origin", credentialed, restricted, "https://other.org", "https://other.org", false},
+		{"restricted key, refused origin", credentialed, restricted, "https://api.example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			if tt.origin != "" {
+				ctx.Request.Header.Set("Origin", tt.origin)
+			}
+			tt.policy.setOrigin(ctx, tt.key)
+
+			allowOrigin := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin"))
+			credentials := string(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")) == "true"
+			if allowOrigin != tt.allowOrigin || credentials != tt.credentials {
+				t.Errorf("Allow-Origin %q, Allow-Credentials %v; want %q, %v", allowOrigin, credentials, tt.allowOrigin, tt.credentials)
+			}
+		})
+	}
+}
+
+func TestCORSSetHeadersOnceKeyIsKnown(t *testing.T) {
+	policy, _ := newCORSPolicy("Content-Type", time.Minute, true, []string{"https://app.example.com"})
+	restricted := &database.KeyInfo{AllowedOrigins: []string{"https://other.org"}}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Origin", "https://app.example.com")
+
+	// Before the key is known, errors get the shared policy
+	policy.setHeaders(ctx, nil)
+	if got := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")); got != "https://app.example.com" {
+		t.Errorf("Allow-Origin before the key = %q", got)
+	}
+	if got := string(ctx.Response.Header.Peek("Access-Control-Expose-Headers")); !strings.Contains(got, "RateLimit-Remaining") || !strings.Contains(got, "Retry-After") {
+		t.Errorf("Expose-Headers = %q, want the quota headers", got)
+	}
+
+	// A key that refuses the origin takes the headers back
+	policy.setHeaders(ctx, restricted)
+	if got := ctx.Response.Header.Peek("Access-Control-Allow-Origin"); got != nil {
+		t.Errorf("Allow-Origin = %q after the key refused the origin", got)
+	}
+	if got := ctx.Response.Header.Peek("Access-Control-Allow-Credentials"); got != nil {
+		t.Errorf("Allow-Credentials = %q after the key refused the origin", got)
+	}
+	if vary := ctx.Response.Header.PeekAll("Vary"); len(vary) != 1 {
+		t.Errorf("Vary = %q, want Origin once", vary)
+	}
+}
@@ -1,24 +1,29 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
-	"database/sql"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/patrickmn/go-cache"
 	"github.com/valyala/fasthttp"
 
+	"proxy/auth"
 	"proxy/config"
 	"proxy/database"
-	"proxy/metrics"
+	"proxy/jsonrpc"
+	"proxy/upstream"
 	"proxy/utils"
 )
 
-func StartFastHTTPServer(apiCache *cache.Cache, usageCache *cache.Cache, usageMutexMap *sync.Map, addr string, db *sql.DB) {
-	httpEndpoints, wsEndpoints, _ := config.LoadChainMap()
+func StartFastHTTPServer(keys *KeyLookup, extractor *utils.KeyExtractor, usageStore utils.UsageStore, rateLimitMap *sync.Map, addr string, pool *upstream.Pool) {
+	trustedHops := config.TrustedProxyHops()
+	cors, err := newCORSPolicy(config.LoadCORSConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	requestHandler := func(ctx *fasthttp.RequestCtx) {
 		path := string(ctx.Path())
@@ -29,40 +34,125 @@ func StartFastHTTPServer(apiCache *cache.Cache, usageCache *cache.Cache, usageMu
 			return
 		}
 
-		apiKey, path, err := utils.ExtractAPIKeyAndPath(ctx)
+		// Browsers send preflights without credentials, so they are answered
+		// before the API key is looked at
+		if ctx.IsOptions() {
+			cors.preflight(ctx)
+			return
+		}
+
+		// Error responses carry CORS headers too, so browser clients can read
+		// them; the key's own policy replaces these once the key is known
+		cors.setHeaders(ctx, nil)
+
+		apiKey, transport, path, err := extractor.Extract(ctx)
 		if err != nil || apiKey == "" {
-			ctx.Error("Forbidden", fasthttp.StatusForbidden)
+			utils.WriteJSONError(ctx, "Forbidden", fasthttp.StatusForbidden)
 			return
 		}
 
-		cacheEntry, found := apiCache.Get(apiKey)
-		if !found {
-			cacheEntry, err = database.FetchAPIKeyInfo(db, apiKey)
-			if err != nil {
-				if err == sql.ErrNoRows {
-					ctx.Error("Invalid API key", fasthttp.StatusForbidden)
-					metrics.MetricAPICache.WithLabelValues("INVALID").Inc()
-				} else {
-					ctx.Error("Internal server error", fasthttp.StatusInternalServerError)
-				}
+		// Signed tokens stand in for keys without touching the key store
+		var key *database.KeyInfo
+		if auth.Enabled() && auth.LooksLikeToken(apiKey) {
+			key, err = auth.Verify(apiKey)
+			if errors.Is(err, auth.ErrTokenExpired) {
+				utils.WriteJSONError(ctx, "Token has expired", fasthttp.StatusUnauthorized)
+				return
+			} else if err != nil {
+				utils.WriteJSONError(ctx, "Invalid token", fasthttp.StatusUnauthorized)
 				return
 			}
-			apiCache.Set(apiKey, cacheEntry, 6*time.Hour)
+		} else if key, err = keys.lookup(apiKey); err != nil {
+			if err == database.ErrKeyNotFound {
+				utils.WriteJSONError(ctx, "Invalid API key", fasthttp.StatusForbidden)
+			} else {
+				utils.WriteJSONError(ctx, "Internal server error", fasthttp.StatusInternalServerError)
+			}
+			return
 		}
 
-		// Rate limiting
-		limit := cacheEntry.(map[string]interface{})["limit"].(int)
-		if !utils.IncrementAPIUsage(apiKey, limit, usageCache, usageMutexMap) {
-			ctx.Error("Slow down you have hit your daily request limit", fasthttp.StatusTooManyRequests)
+		cors.setHeaders(ctx, key)
+
+		if !key.Enabled {
+			utils.WriteJSONError(ctx, "API key has been revoked", fasthttp.StatusForbidden)
+			return
+		}
+		if !key.ExpiresAt.IsZero() && !utils.Now().Before(key.ExpiresAt) {
+			utils.WriteJSONError(ctx, "API key has expired", fasthttp.StatusUnauthorized)
+			return
+		}
+
+		// Origin, IP and User-Agent restrictions of the key
+		if msg := checkAccess(ctx, key, trustedHops); msg != "" {
+			utils.WriteJSONError(ctx, msg, fasthttp.StatusForbidden)
+			return
+		}
+
+		// The chain comes from the path if the key may use more than one
+		chainName, rest, known := routeRequest(key, path, transport, pool)
+		if !known {
+			utils.WriteJSONError(ctx, fmt.Sprintf("Unknown chain %s", chainName), fasthttp.StatusNotFound)
+			return
+		}
+		if !key.AllowsChain(chainName) {
+			utils.WriteJSONError(ctx, fmt.Sprintf("API key is not authorized for chain %s", chainName), fasthttp.StatusForbidden)
+			return
+		}
+
+		// Per-second rate limiting, checked first so throttled requests don't use up the daily quota
+		if ok, wait := utils.AllowRequest(key.ID, key.RPS, key.Burst, rateLimitMap); !ok {
+			ctx.Response.Header.Set("Retry-After", strconv.Itoa(utils.RetryAfterSeconds(wait)))
+			utils.WriteJSONError(ctx, "Slow down you have exceeded your request rate limit", fasthttp.StatusTooManyRequests)
+			return
+		}
+
+		// Batches that don't parse are refused, as their calls can't all be
+		// checked against the method policy, capped or counted
+		if _, batch, err := jsonrpc.Parse(ctx.Request.Body()); err != nil && batch {
+			writeInvalidRequest(ctx, "invalid JSON-RPC batch")
+			return
+		}
+
+		// Batch size cap, checked before charging so oversized batches cost nothing
+		if limit := maxBatchSize(key); limit > 0 {
+			if n := jsonrpc.CallCount(ctx.Request.Body()); n > limit {
+				writeInvalidRequest(ctx, fmt.Sprintf("batch of %d calls exceeds the limit of %d", n, limit))
+				return
+			}
+		}
+
+		// Quota, charged by the compute units of the JSON-RPC calls in the body.
+		// Upgrades are only checked, their frames are charged as they arrive.
+		quota := quotaFor(key)
+		chain := pool.Chain(chainName)
+		usageKey := key.UsageKey(key.ID, chainName)
+		websocket := utils.IsWebSocketRequest(ctx)
+		var usage utils.APIUsage
+		var ok bool
+		if websocket {
+			usage, ok = checkQuota(usageStore, usageKey, quota)
+		} else {
+			usage, ok = chargeRequest(usageStore, usageKey, quota, chain, ctx.Request.Body())
+		}
+		utils.SetRateLimitHeaders(ctx, quota, usage)
+		if !ok {
+			ctx.Response.Header.Set("Retry-After", strconv.Itoa(utils.RetryAfterSeconds(usage.ResetAt.Sub(utils.Now()))))
+			utils.WriteJSONError(ctx, fmt.Sprintf("Slow down you have hit your %s request limit, it resets at %s",
+				quotaPeriodName(quota.Period), usage.ResetAt.Format(time.RFC3339)), fasthttp.StatusTooManyRequests)
 			return
 		}
 
 		// Routing
-		if utils.IsWebSocketRequest(ctx) {
-			handleWebSocketRequest(ctx, apiKey, wsEndpoints, cacheEntry.(map[string]interface{}))
+		if websocket {
+			charge := func(message []byte) bool {
+				_, ok := chargeRequest(usageStore, usageKey, quota, chain, message)
+				return ok
+			}
+			handleWebSocketRequest(ctx, apiKey, chainName, pool, key, charge)
 			return
 		}
-		handleHTTPRequest(ctx, httpEndpoints, apiKey, path, cacheEntry.(map[string]interface{}), usageCache, usageMutexMap)
+		forwardPath := utils.ForwardPath(rest, string(ctx.QueryArgs().QueryString()))
+		handleHTTPRequest(ctx, pool, apiKey, chainName, forwardPath, key)
 	}
 
 	server := &fasthttp.Server{
@@ -72,3 +162,11 @@ func StartFastHTTPServer(apiCache *cache.Cache, usageCache *cache.Cache, usageMu
 	}
 	log.Fatal(server.ListenAndServe(addr))
 }
+
+// writeInvalidRequest answers the whole body with a single JSON-RPC
+// invalid request error
+func writeInvalidRequest(ctx *fasthttp.RequestCtx, msg string) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(jsonrpc.Marshal([]jsonrpc.Response{jsonrpc.ErrorResponse(nil, jsonrpc.CodeInvalidRequest, msg)}, false))
+}
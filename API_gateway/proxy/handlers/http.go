@@ -3,41 +3,26 @@ package handlers
 import (
 	"log"
 	"strconv"
-	"sync"
 	"time"
 
-	"github.com/patrickmn/go-cache"
 	"github.com/valyala/fasthttp"
 
+	"proxy/database"
+	"proxy/jsonrpc"
 	"proxy/metrics"
 	"proxy/proxy"
+	"proxy/upstream"
 	"proxy/utils"
 )
 
-func handleHTTPRequest(ctx *fasthttp.RequestCtx, chainMap map[string][]string, apiKey string, path string, keyData map[string]interface{}, usageCache *cache.Cache, usageMutexMap *sync.Map) {
+func handleHTTPRequest(ctx *fasthttp.RequestCtx, pool *upstream.Pool, apiKey, chain, path string, key *database.KeyInfo) {
 	timeoutDuration := 20 * time.Second
 
 	// Create a channel to signal the completion of the request
 	done := make(chan struct{}, 1)
 
 	go func() {
-		setCORSHeaders := func() {
-			if len(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) == 0 {
-				ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
-			}
-
-			if len(ctx.Response.Header.Peek("Access-Control-Allow-Methods")) == 0 {
-				ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			}
-
-			if len(ctx.Response.Header.Peek("Access-Control-Allow-Headers")) == 0 {
-				ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, solana-client")
-			}
-		}
-
-		setCORSHeaders()
-
-		handleCachedAPIKey(ctx, apiKey, keyData, chainMap, usageCache, usageMutexMap)
+		handleCachedAPIKey(ctx, apiKey, chain, path, key, pool)
 
 		done <- struct{}{}
 	}()
@@ -48,36 +33,20 @@ func handleHTTPRequest(ctx *fasthttp.RequestCtx, chainMap map[string][]string, a
 		// Request completed successfully within the timeout
 	case <-time.After(timeoutDuration):
 		// Timeout reached, send a timeout response
-		ctx.Error("Request timed out", fasthttp.StatusRequestTimeout)
+		utils.WriteJSONError(ctx, "Request timed out", fasthttp.StatusRequestTimeout)
 	}
 }
 
 // handleCachedAPIKey handles requests with cached API key
-func handleCachedAPIKey(ctx *fasthttp.RequestCtx, apiKey string, keyData map[string]interface{}, chainMap map[string][]string, usageCache *cache.Cache, usageMutexMap *sync.Map) {
-	// Check if all required keys exist in the keyData map
-	requiredKeys := []string{"limit", "chain", "org", "org_id"}
-	for _, key := range requiredKeys {
-		if _, ok := keyData[key]; !ok {
-			log.Printf("Key '%s' not found in keyData", key)
-			return
-		}
-	}
-
-	// Convert the "limit" value to an int
-	limit, ok := keyData["limit"].(int)
-	if !ok {
-		log.Println("Value associated with 'limit' key is not of type int")
-		return
-	}
-
-	// Proceed with the request handling
-	if !utils.IncrementAPIUsage(apiKey, limit, usageCache, usageMutexMap) {
-		usageCache.Delete(apiKey)
-		ctx.Error("Slow down you have hit your daily request limit", fasthttp.StatusTooManyRequests)
+func handleCachedAPIKey(ctx *fasthttp.RequestCtx, apiKey, chain, path string, key *database.KeyInfo, pool *upstream.Pool) {
+	if chain == "" {
+		log.Printf("No chain configured for API key %s", key.ID)
 		return
 	}
 
-	proxy.ProxyHttpRequest(ctx, &ctx.Request, keyData["chain"].(string), chainMap, apiKey, keyData)
-	metrics.MetricRequestsAPI.WithLabelValues(apiKey, keyData["org"].(string), keyData["org_id"].(string), keyData["chain"].(string), strconv.Itoa(ctx.Response.StatusCode())).Inc()
-	metrics.MetricAPICache.WithLabelValues("HIT").Inc()
+	// The quota was already charged in StartFastHTTPServer
+	proxy.ProxyHttpRequest(ctx, &ctx.Request, chain, path, pool, apiKey, key)
+	// Every call of a batch counts as a request
+	calls := jsonrpc.CallCount(ctx.Request.Body())
+	metrics.MetricRequestsAPI.WithLabelValues(key.ID, key.Org, key.OrgID, chain, strconv.Itoa(ctx.Response.StatusCode())).Add(float64(calls))
 }
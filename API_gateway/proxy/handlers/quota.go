@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"proxy/config"
+	"proxy/database"
+	"proxy/jsonrpc"
+	"proxy/metrics"
+	"proxy/upstream"
+	"proxy/utils"
+)
+
+// quotaFor builds the quota of a key
+func quotaFor(key *database.KeyInfo) utils.Quota {
+	quota := utils.Quota{
+		Limit:  key.Limit,
+		Period: key.QuotaPeriod,
+		Anchor: key.BillingAnchor,
+	}
+	if !utils.IsQuotaPeriod(quota.Period) {
+		quota.Period = utils.DefaultQuotaPeriod()
+	}
+	return quota
+}
+
+// maxBatchSize returns the largest JSON-RPC batch the key may send, 0 for no cap
+func maxBatchSize(key *database.KeyInfo) int {
+	if key.MaxBatchSize > 0 {
+		return key.MaxBatchSize
+	}
+	return config.DefaultMaxBatchSize()
+}
+
+func quotaPeriodName(period string) string {
+	if period == utils.QuotaMonthly {
+		return "monthly"
+	}
+	return "daily"
+}
+
+// checkQuota returns the key's usage without charging it, and whether any of
+// its quota is left. WebSocket upgrades are checked this way, as each frame
+// sent over the connection is charged on its own.
+func checkQuota(usageStore utils.UsageStore, apiKey string, quota utils.Quota) (utils.APIUsage, bool) {
+	usage, _ := utils.IncrementAPIUsage(usageStore, apiKey, quota, 0)
+	return usage, quota.Limit == 0 || usage.Count < int64(quota.Limit)
+}
+
+// chargeRequest debits the compute units of body from the key's quota. Each
+// call of a JSON-RPC batch is priced separately, even in batches that don't
+// parse as a whole, and entries without a method cost the chain's default;
+// bodies that are not JSON cost the default once.
+func chargeRequest(usageStore utils.UsageStore, apiKey string, quota utils.Quota, chain *upstream.Chain, body []byte) (utils.APIUsage, bool) {
+	methods, ok := jsonrpc.Methods(body)
+	if !ok || chain == nil {
+		cost := int64(1)
+		if chain != nil {
+			cost = int64(chain.Config.MethodCost(""))
+		}
+		return utils.IncrementAPIUsage(usageStore, apiKey, quota, cost)
+	}
+
+	var cost int64
+	costs := make(map[string]int64, len(methods))
+	for _, method := range methods {
+		c := int64(chain.Config.MethodCost(method))
+		cost += c
+		costs[method] += c
+	}
+
+	usage, ok := utils.IncrementAPIUsage(usageStore, apiKey, quota, cost)
+	if ok {
+		for method, c := range costs {
+			// Only priced methods get their own series to bound label cardinality
+			if _, priced := chain.Config.MethodCosts[method]; !priced {
+				method = "other"
+			}
+			metrics.ComputeUnits.WithLabelValues(chain.Name, method).Add(float64(c))
+		}
+	}
+	return usage, ok
+}
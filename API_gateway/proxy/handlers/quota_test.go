@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"proxy/config"
+	"proxy/upstream"
+	"proxy/utils"
+)
+
+func TestChargeRequest(t *testing.T) {
+	chain := &upstream.Chain{Name: "eth", Config: config.Chain{
+		MethodCosts: map[string]int{"eth_getLogs": 75, "eth_call": 10},
+		DefaultCost: 2,
+	}}
+	getLogs := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{}]}`
+
+	tests := []struct {
+		name string
+		body string
+		cost int64
+	}{
+		{"single call", getLogs, 75},
+		{"unpriced method", `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`, 2},
+		{"batch", "[" + getLogs + "," + strings.Replace(getLogs, "eth_getLogs", "eth_call", 1) + "]", 85},
+		{"batch with an entry without method", "[" + strings.Repeat(getLogs+",", 500) + `{"id":2}]`, 500*75 + 2},
+		{"call with trailing bytes", getLogs + " x", 75},
+		{"not JSON", "hello", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := utils.NewMemoryUsageStore(cache.New(time.Hour, time.Hour), &sync.Map{})
+			usage, ok := chargeRequest(store, "key", utils.Quota{Period: utils.QuotaDaily}, chain, []byte(tt.body))
+			if !ok || usage.Count != tt.cost {
+				t.Errorf("charged %d (allowed %v), want %d", usage.Count, ok, tt.cost)
+			}
+		})
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	store := utils.NewMemoryUsageStore(cache.New(time.Hour, time.Hour), &sync.Map{})
+	quota := utils.Quota{Limit: 3, Period: utils.QuotaDaily}
+
+	// Checking charges nothing
+	for i := 0; i < 3; i++ {
+		if usage, ok := checkQuota(store, "key", quota); !ok || usage.Count != 0 {
+			t.Fatalf("check %d = %d, %v; want 0, true", i, usage.Count, ok)
+		}
+	}
+
+	// A used up quota refuses the upgrade, one with units left doesn't
+	utils.IncrementAPIUsage(store, "key", quota, 2)
+	if _, ok := checkQuota(store, "key", quota); !ok {
+		t.Error("check refused with one unit left")
+	}
+	utils.IncrementAPIUsage(store, "key", quota, 1)
+	if usage, ok := checkQuota(store, "key", quota); ok || usage.Count != 3 {
+		t.Errorf("check = %d, %v; want 3, false", usage.Count, ok)
+	}
+
+	// No limit is never used up
+	if _, ok := checkQuota(store, "other", utils.Quota{Period: utils.QuotaDaily}); !ok {
+		t.Error("check refused without a limit")
+	}
+}
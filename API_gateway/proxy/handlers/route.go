@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"proxy/database"
+	"proxy/upstream"
+	"proxy/utils"
+)
+
+// routeRequest returns the chain a request is for and the path segments to
+// forward upstream. The chain may be named in the path, right after the key
+// (/api=<key>/<chain>/...) or before it (/<chain>/api=<key>/...), and
+// defaults to the key's own chain. With other transports the chain may be the
+// first segment of the path. A segment after the key is only taken as the
+// chain for multi-chain keys that may use it; for other keys it is part of
+// the path to forward. ok is false if the path names a chain before the key
+// that is not configured.
+func routeRequest(key *database.KeyInfo, path, transport string, pool *upstream.Pool) (chain string, rest []string, ok bool) {
+	prefix, apiKey, rest := utils.SplitKeyPath(path)
+	if prefix != "" {
+		// Unknown chains would otherwise create metric series and usage entries at will
+		if pool.Chain(prefix) == nil {
+			return prefix, nil, false
+		}
+		return prefix, rest, true
+	}
+	if apiKey == "" {
+		if len(rest) > 0 && selectsChain(key, rest[0], pool) {
+			return rest[0], rest[1:], true
+		}
+		// X-API-Key requests always had their first segment dropped, as if it held the key
+		if transport == utils.KeyInHeader && len(rest) > 0 {
+			return key.Chain, rest[1:], true
+		}
+		if len(rest) == 1 && rest[0] == "" {
+			return key.Chain, nil, true
+		}
+		return key.Chain, rest, true
+	}
+	if len(rest) > 0 && selectsChain(key, rest[0], pool) {
+		return rest[0], rest[1:], true
+	}
+	return key.Chain, rest, true
+}
+
+// selectsChain reports whether a path segment picks the chain of a request:
+// the key must be multi-chain and allowed to use the configured chain named
+func selectsChain(key *database.KeyInfo, segment string, pool *upstream.Pool) bool {
+	return segment != "" && len(key.AllowedChains) > 0 && key.AllowsChain(segment) && pool.Chain(segment) != nil
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+
+	"proxy/config"
+	"proxy/database"
+	"proxy/upstream"
+	"proxy/utils"
+)
+
+func TestRouteRequest(t *testing.T) {
+	pool := upstream.NewPool(&config.ChainMap{Chains: map[string]config.Chain{"ethereum": {}, "base": {}, "polygon": {}}})
+	key := &database.KeyInfo{Chain: "ethereum", AllowedChains: []string{"base", "ethereum"}}
+
+	tests := []struct {
+		name      string
+		path      string
+		transport string
+		chain     string
+		rest      []string
+		known     bool
+	}{
+		{"key only", "/api=k", utils.KeyInPath, "ethereum", []string{}, true},
+		{"chain after key", "/api=k/base/rpc", utils.KeyInPath, "base", []string{"rpc"}, true},
+		{"path after key", "/api=k/ext/rpc", utils.KeyInPath, "ethereum", []string{"ext", "rpc"}, true},
+		{"chain before key", "/base/api=k/rpc", utils.KeyInPath, "base", []string{"rpc"}, true},
+		{"unknown chain before key", "/made-up/api=k/rpc", utils.KeyInPath, "made-up", nil, false},
+		{"chain in header request", "/base/rpc", utils.KeyInHeader, "base", []string{"rpc"}, true},
+		{"header request drops first segment", "/x/rpc", utils.KeyInHeader, "ethereum", []string{"rpc"}, true},
+		{"bearer request keeps path", "/ext/rpc", utils.KeyInBearer, "ethereum", []string{"ext", "rpc"}, true},
+		{"bearer request at root", "/", utils.KeyInBearer, "ethereum", nil, true},
+		{"chain not allowed for key is forwarded", "/api=k/polygon/rpc", utils.KeyInPath, "ethereum", []string{"polygon", "rpc"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, rest, known := routeRequest(key, tt.path, tt.transport, pool)
+			if chain != tt.chain || !slices.Equal(rest, tt.rest) || known != tt.known {
+				t.Errorf("routeRequest(%s) = %s, %q, %v; want %s, %q, %v", tt.path, chain, rest, known, tt.chain, tt.rest, tt.known)
+			}
+		})
+	}
+}
+
+func TestRouteRequestSingleChainKey(t *testing.T) {
+	pool := upstream.NewPool(&config.ChainMap{Chains: map[string]config.Chain{"ethereum": {}, "base": {}}})
+	key := &database.KeyInfo{Chain: "ethereum"}
+
+	tests := []struct {
+		name      string
+		path      string
+		transport string
+		chain     string
+		rest      []string
+	}{
+		{"path naming another chain is forwarded", "/api=k/base/rpc", utils.KeyInPath, "ethereum", []string{"base", "rpc"}},
+		{"path naming its own chain is forwarded", "/api=k/ethereum", utils.KeyInPath, "ethereum", []string{"ethereum"}},
+		{"bearer path naming a chain is forwarded", "/base/rpc", utils.KeyInBearer, "ethereum", []string{"base", "rpc"}},
+		{"header request drops first segment", "/base/rpc", utils.KeyInHeader, "ethereum", []string{"rpc"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, rest, known := routeRequest(key, tt.path, tt.transport, pool)
+			if chain != tt.chain || !slices.Equal(rest, tt.rest) || !known {
+				t.Errorf("routeRequest(%s) = %s, %q, %v; want %s, %q", tt.path, chain, rest, known, tt.chain, tt.rest)
+			}
+		})
+	}
+}
@@ -9,15 +9,21 @@ import (
 	"github.com/fasthttp/websocket"
 	"github.com/valyala/fasthttp"
 
+	"proxy/database"
+	"proxy/jsonrpc"
 	"proxy/proxy"
+	"proxy/upstream"
 )
 
-func handleWebSocketRequest(ctx *fasthttp.RequestCtx, apiKey string, chainMap map[string][]string, keyData map[string]interface{}) {
+// handleWebSocketRequest proxies a WebSocket connection. charge is called
+// with every frame the client sends and reports whether it fits the key's quota.
+func handleWebSocketRequest(ctx *fasthttp.RequestCtx, apiKey, chainName string, pool *upstream.Pool, key *database.KeyInfo, charge func(message []byte) bool) {
 	upgrader := websocket.FastHTTPUpgrader{
 		ReadBufferSize:  32768,
 		WriteBufferSize: 32768,
+		// Keys without an origin allowlist may be used from any page
 		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
-			return true
+			return key.AllowsOrigin(requestOrigin(ctx))
 		},
 	}
 
@@ -26,14 +32,17 @@ func handleWebSocketRequest(ctx *fasthttp.RequestCtx, apiKey string, chainMap ma
 
 		conn.SetReadDeadline(time.Time{})
 
-		chainName := keyData["chain"].(string)
-		chainCode, ok := chainMap[chainName]
-		if !ok || len(chainCode) == 0 {
+		var endpoint *upstream.Endpoint
+		c := pool.Chain(chainName)
+		if c != nil {
+			endpoint = c.Pick(upstream.WS, nil)
+		}
+		if endpoint == nil {
 			log.Printf("Invalid chain name or no backend URL for chain: %s", chainName)
 			return
 		}
 
-		backendURL := chainCode[0]
+		backendURL := endpoint.URL
 
 		headers := http.Header{}
 		headers.Add("API-Key", apiKey)
@@ -45,7 +54,13 @@ func handleWebSocketRequest(ctx *fasthttp.RequestCtx, apiKey string, chainMap ma
 			headers.Add("X-Forwarded-For", ctx.RemoteIP().String())
 		}
 
+		// The connection counts as in flight on the endpoint for its lifetime
+		endpoint.Acquire()
+		defer endpoint.Release()
+
+		start := time.Now()
 		backendConn, _, err := websocket.DefaultDialer.Dial(backendURL, headers)
+		endpoint.Observe(time.Since(start), err == nil)
 		if err != nil {
 			log.Printf("Failed to connect to backend: %s", err)
 			return
@@ -80,13 +95,25 @@ func handleWebSocketRequest(ctx *fasthttp.RequestCtx, apiKey string, chainMap ma
 
 		wg.Add(2)
 
+		// Only frames from the client are checked against the method policy and charged
+		methodFilter := proxy.MethodFilter(proxy.MethodPolicyFor(c, key))
+		inspect := func(message []byte) []byte {
+			if reply := methodFilter(message); reply != nil {
+				return reply
+			}
+			if !charge(message) {
+				return jsonrpc.RejectBody(message, jsonrpc.CodeLimitExceeded, "request limit exceeded")
+			}
+			return nil
+		}
+
 		go func() {
 			defer wg.Done()
-			proxy.ProxyWebSocketMessages(conn, backendConn, apiKey, keyData, done, writeMutex)
+			proxy.ProxyWebSocketMessages(conn, backendConn, chainName, key, done, writeMutex, inspect)
 		}()
 		go func() {
 			defer wg.Done()
-			proxy.ProxyWebSocketMessages(backendConn, conn, apiKey, keyData, done, writeMutex)
+			proxy.ProxyWebSocketMessages(backendConn, conn, chainName, key, done, writeMutex, nil)
 		}()
 
 		wg.Wait()
@@ -0,0 +1,187 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// Error codes used by the gateway
+const (
+	CodeMethodNotAllowed = -32601
+	CodeInvalidRequest   = -32600
+	CodeLimitExceeded    = -32005
+	CodeInternalError    = -32603
+)
+
+var errNotJSONRPC = errors.New("body is not a JSON-RPC request")
+
+// Request is a single JSON-RPC call
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is a single JSON-RPC reply
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Parse decodes body as a single call or a batch of calls. batch reports
+// whether the body was an array. It fails for anything that is not JSON-RPC,
+// such as REST bodies, so callers can pass those through untouched.
+func Parse(body []byte) (calls []Request, batch bool, err error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, false, errNotJSONRPC
+	}
+
+	if body[0] == '[' {
+		if err := json.Unmarshal(body, &calls); err != nil {
+			return nil, true, err
+		}
+		for _, c := range calls {
+			if c.Method == "" {
+				return nil, true, errNotJSONRPC
+			}
+		}
+		return calls, true, nil
+	}
+
+	var call Request
+	if err := json.Unmarshal(body, &call); err != nil {
+		return nil, false, err
+	}
+	if call.Method == "" {
+		return nil, false, errNotJSONRPC
+	}
+	return []Request{call}, false, nil
+}
+
+// LooksLikeJSON reports whether body is a JSON object or array, which
+// upstreams may try to run as JSON-RPC even where Parse rejects it
+func LooksLikeJSON(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) > 0 && (body[0] == '{' || body[0] == '[')
+}
+
+// Methods returns the method of every call in body for pricing. Each entry
+// of a batch is decoded on its own, so one malformed entry doesn't hide the
+// others; entries without a method give "". ok is false if body is not a
+// JSON object or array.
+func Methods(body []byte) (methods []string, ok bool) {
+	body = bytes.TrimSpace(body)
+	if !LooksLikeJSON(body) {
+		return nil, false
+	}
+
+	entries := []json.RawMessage{body}
+	if body[0] == '[' {
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&entries); err != nil {
+			return nil, false
+		}
+	}
+
+	methods = make([]string, len(entries))
+	for i, entry := range entries {
+		var call struct {
+			Method string `json:"method"`
+		}
+		// A Decoder stops after the first value, as upstreams do
+		if json.NewDecoder(bytes.NewReader(entry)).Decode(&call) == nil {
+			methods[i] = call.Method
+		}
+	}
+	return methods, true
+}
+
+// ErrorResponse builds an error reply for the call with the given id
+func ErrorResponse(id json.RawMessage, code int, msg string) Response {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return Response{JSONRPC: "2.0", ID: id, Error: &Error{Code: code, Message: msg}}
+}
+
+// Marshal encodes responses as a batch array or, if batch is false, as the
+// single response it holds.
+func Marshal(responses []Response, batch bool) []byte {
+	var body []byte
+	if batch {
+		body, _ = json.Marshal(responses)
+	} else if len(responses) > 0 {
+		body, _ = json.Marshal(responses[0])
+	}
+	return body
+}
+
+// RejectBody answers every call in body with the same error. Bodies that are
+// not JSON-RPC get a single error with a null id.
+func RejectBody(body []byte, code int, msg string) []byte {
+	calls, batch, err := Parse(body)
+	if err != nil {
+		return Marshal([]Response{ErrorResponse(nil, code, msg)}, false)
+	}
+
+	responses := make([]Response, len(calls))
+	for i, call := range calls {
+		responses[i] = ErrorResponse(call.ID, code, msg)
+	}
+	return Marshal(responses, batch)
+}
+
+// CallCount returns the number of calls in body, counting every entry of a
+// batch even if the batch doesn't parse, and anything else as one
+func CallCount(body []byte) int {
+	methods, ok := Methods(body)
+	if !ok || len(methods) == 0 {
+		return 1
+	}
+	return len(methods)
+}
+
+// ErrorsFor answers every call in calls with the same error, skipping notifications
+func ErrorsFor(calls []Request, code int, msg string) []Response {
+	responses := make([]Response, 0, len(calls))
+	for _, call := range calls {
+		if len(call.ID) > 0 {
+			responses = append(responses, ErrorResponse(call.ID, code, msg))
+		}
+	}
+	return responses
+}
+
+// Match orders responses to follow calls, matching them by id. Calls left
+// without a response get an error; notifications get none.
+func Match(calls []Request, responses []Response) []Response {
+	byID := make(map[string][]Response, len(responses))
+	for _, r := range responses {
+		byID[string(r.ID)] = append(byID[string(r.ID)], r)
+	}
+
+	ordered := make([]Response, 0, len(calls))
+	for _, call := range calls {
+		if len(call.ID) == 0 {
+			continue
+		}
+		id := string(call.ID)
+		if queue := byID[id]; len(queue) > 0 {
+			ordered = append(ordered, queue[0])
+			byID[id] = queue[1:]
+			continue
+		}
+		ordered = append(ordered, ErrorResponse(call.ID, CodeInternalError, "no response from upstream"))
+	}
+	return ordered
+}
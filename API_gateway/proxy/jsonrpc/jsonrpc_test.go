@@ -0,0 +1,55 @@
+package jsonrpc
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		methods []string
+		ok      bool
+	}{
+		{"single call", `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs"}`, []string{"eth_getLogs"}, true},
+		{"trailing bytes", `{"id":1,"method":"eth_getLogs"} x`, []string{"eth_getLogs"}, true},
+		{"batch", `[{"id":1,"method":"eth_getLogs"},{"id":2,"method":"eth_call"}]`, []string{"eth_getLogs", "eth_call"}, true},
+		{"batch entry without method", `[{"id":1,"method":"eth_getLogs"},{"id":2}]`, []string{"eth_getLogs", ""}, true},
+		{"batch entry that is not an object", `[{"id":1,"method":"eth_getLogs"},3]`, []string{"eth_getLogs", ""}, true},
+		{"truncated batch", `[{"id":1,"method":"eth_getLogs"}`, nil, false},
+		{"not JSON", `hello`, nil, false},
+		{"empty", ``, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods, ok := Methods([]byte(tt.body))
+			if ok != tt.ok || !slices.Equal(methods, tt.methods) {
+				t.Errorf("Methods(%s) = %q, %v; want %q, %v", tt.body, methods, ok, tt.methods, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCallCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		count int
+	}{
+		{"single call", `{"id":1,"method":"eth_call"}`, 1},
+		{"batch", `[{"id":1,"method":"eth_call"},{"id":2,"method":"eth_call"},{"id":3,"method":"eth_call"}]`, 3},
+		{"batch with an entry without method", `[{"id":1,"method":"eth_call"},{"id":2,"method":"eth_call"},{"id":3}]`, 3},
+		{"not JSON", `hello`, 1},
+		{"empty batch", `[]`, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CallCount([]byte(tt.body)); got != tt.count {
+				t.Errorf("CallCount(%s) = %d, want %d", tt.body, got, tt.count)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"log"
@@ -13,15 +14,22 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"proxy/admin"
+	"proxy/auth"
+	"proxy/config"
+	"proxy/database"
 	"proxy/handlers"
 	"proxy/metrics"
-	"proxy/database"
+	"proxy/proxy"
+	"proxy/upstream"
+	"proxy/utils"
 )
 
 var (
 	apiCache      *cache.Cache
 	usageCache    *cache.Cache
 	usageMutexMap sync.Map
+	rateLimitMap  sync.Map
 )
 
 var (
@@ -33,6 +41,7 @@ func main() {
 	verFlag := flag.Bool("v", false, "Print the version and Git commit hash and exit")
 	proxyPort := flag.Int("port.proxy", 80, "Port for the proxy server")
 	metricsPort := flag.Int("port.metrics", 9090, "Port for the metrics server")
+	hashKey := flag.String("hash-key", "", "Print the api_key_hash value of an API key and exit")
 
 	// Parse command-line flags
 	flag.Parse()
@@ -44,6 +53,24 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Hash a key for the api_key_hash column, with the secret from the environment or .env
+	if *hashKey != "" {
+		_ = godotenv.Load()
+		secret, _ := config.LoadKeyHashConfig()
+		if secret == "" {
+			log.Fatal("API_KEY_HMAC_SECRET is not set")
+		}
+		extractor, err := utils.NewKeyExtractor(config.LoadKeyTransports())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := extractor.CheckKey(*hashKey); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(database.NewKeyHasher(secret).Hash(*hashKey))
+		os.Exit(0)
+	}
+
 	// Print welcome message
 	fmt.Println("Welcome to the Liquify API Gateway!")
 	fmt.Println("This gateway is developed by Liquify LTD.")
@@ -65,16 +92,107 @@ func main() {
 
 	// Start FastHTTP server to handle requests
 	proxyAddr := fmt.Sprintf(":%d", *proxyPort)
-	db, err := database.InitDB()
+
+	// Load chain config and watch it for changes (file edits or SIGHUP)
+	chains, err := config.NewChainStore(config.ConfigPath())
 	if err != nil {
-		log.Printf("Error initializing DB: %v", err)
-		os.Exit(1)
+		log.Fatalf("Error loading chain config: %s", err)
+	}
+	go chains.Watch(config.ReloadInterval())
+
+	// Track upstream endpoints and keep probing them in the background
+	pool := upstream.NewPool(chains.Current())
+	chains.OnReload(pool.Update)
+	proxy.ConfigureResponseCache(chains.Current().ResponseCache)
+	chains.OnReload(func(cm *config.ChainMap) { proxy.ConfigureResponseCache(cm.ResponseCache) })
+	go upstream.RunHealthChecks(pool)
+
+	// Signed JWTs from the issuers in the config are accepted in place of API keys
+	if err := auth.Configure(chains.Current().JWT); err != nil {
+		log.Fatalf("Error loading JWT issuers: %s", err)
+	}
+	chains.OnReload(func(cm *config.ChainMap) {
+		if err := auth.Configure(cm.JWT); err != nil {
+			log.Printf("Error loading JWT issuers, keeping the previous ones: %s", err)
+		}
+	})
+
+	// The database is only opened when usage or keys are kept in it
+	storeKind, flushInterval := config.LoadUsageStoreConfig()
+	keyStoreKind, keyFile := config.LoadKeyStoreConfig()
+	var db *sql.DB
+	var dialect database.Dialect
+	if storeKind == "sql" || keyStoreKind == "sql" {
+		if db, dialect, err = database.InitDB(); err != nil {
+			log.Printf("Error initializing DB: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Quota usage is kept in memory unless it has to be shared between replicas
+	var usageStore utils.UsageStore = utils.NewMemoryUsageStore(usageCache, &usageMutexMap)
+	switch storeKind {
+	case "memory":
+	case "sql":
+		usageStore = database.NewSQLUsageStore(db, dialect, flushInterval)
+	default:
+		log.Fatalf("Unknown USAGE_STORE %q, expected memory or sql", storeKind)
+	}
+
+	// Keys are matched by their HMAC once api_key_hash is populated
+	hmacSecret, lookupMode := config.LoadKeyHashConfig()
+	hasher := database.NewKeyHasher(hmacSecret)
+	if err := database.CheckLookupMode(lookupMode, hasher); err != nil {
+		log.Fatal(err)
+	}
+
+	// Where requests may carry their key, in order of precedence
+	extractor, err := utils.NewKeyExtractor(config.LoadKeyTransports())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// API keys come from the api_keys table unless a key file is configured
+	var keyStore database.KeyStore
+	keyPollInterval := config.KeyPollInterval()
+	switch keyStoreKind {
+	case "sql":
+		sqlKeys := database.NewSQLKeyStore(db, dialect, hasher, lookupMode)
+		keyStore = sqlKeys
+		if err := sqlKeys.CheckSchema(); err != nil {
+			log.Fatal(err)
+		}
+		if keyPollInterval > 0 && !sqlKeys.HasColumn("updated_at") {
+			log.Printf("api_keys has no updated_at column, key changes will not be polled")
+			keyPollInterval = 0
+		}
+	case "file":
+		fileKeys, err := database.LoadFileKeyStore(keyFile)
+		if err != nil {
+			log.Fatalf("Error loading key file: %s", err)
+		}
+		for _, apiKey := range fileKeys.Keys() {
+			if err := extractor.CheckKey(apiKey); err != nil {
+				log.Fatalf("Error loading key file: key %s: %s", hasher.ID(apiKey), err)
+			}
+		}
+		keyStore = fileKeys
+	default:
+		log.Fatalf("Unknown KEY_STORE %q, expected sql or file", keyStoreKind)
+	}
+
+	// Keys are cached in apiCache; changed rows are dropped from it as they are seen
+	keys := handlers.NewKeyLookup(apiCache, keyStore, hasher, usageStore, config.NegativeKeyCacheTTL(), config.KeyStaleGrace())
+	if keyPollInterval > 0 {
+		go keys.WatchChanges(keyPollInterval)
 	}
 
-	go handlers.StartFastHTTPServer(apiCache, usageCache, &usageMutexMap, proxyAddr, db)
+	go handlers.StartFastHTTPServer(keys, extractor, usageStore, &rateLimitMap, proxyAddr, pool)
 
 	metricsAddr := fmt.Sprintf(":%d", *metricsPort)
-	// Expose Prometheus metrics endpoint
+	// Expose Prometheus metrics and admin endpoints
+	adminAPI := &admin.API{Pool: pool, Keys: keys}
+	adminAPI.Register(http.DefaultServeMux)
 	go startPrometheusServer(metricsAddr)
 
 	// Wait indefinitely
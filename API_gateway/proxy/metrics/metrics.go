@@ -19,16 +19,120 @@ var (
 		}, []string{"state"},
 	)
 
+	StaleAPIKeys = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "api_keys_served_stale",
+			Help: "Number of API keys served from expired cache entries because the database could not be reached.",
+		},
+	)
+
 	RequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests.",
 		}, []string{"status_code"},
 	)
+
+	ComputeUnits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "compute_units_total",
+			Help: "Compute units charged to API key quotas by chain and JSON-RPC method.",
+		}, []string{"chain", "method"},
+	)
+
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Number of chain config reloads by result.",
+		}, []string{"result"},
+	)
+
+	ConfigLastReload = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful chain config reload.",
+		},
+	)
+
+	UpstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_endpoint_healthy",
+			Help: "Whether an upstream endpoint is passing health checks (1) or out of rotation (0).",
+		}, []string{"chain", "transport", "endpoint"},
+	)
+
+	UpstreamBlockHeight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_endpoint_block_height",
+			Help: "Latest block height (or slot) reported by an upstream endpoint.",
+		}, []string{"chain", "transport", "endpoint"},
+	)
+
+	UpstreamBlockLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_endpoint_block_lag",
+			Help: "Number of blocks an upstream endpoint is behind the highest endpoint on its chain.",
+		}, []string{"chain", "transport", "endpoint"},
+	)
+
+	UpstreamCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_circuit_state",
+			Help: "Circuit breaker state of an upstream endpoint: 0 closed, 1 half open, 2 open.",
+		}, []string{"chain", "transport", "endpoint"},
+	)
+
+	UpstreamCircuitTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_circuit_transitions_total",
+			Help: "Number of circuit breaker state changes by the state entered.",
+		}, []string{"chain", "transport", "endpoint", "state"},
+	)
+
+	ResponseCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "response_cache_requests_total",
+			Help: "Response cache lookups for cacheable JSON-RPC methods by result (hit or miss).",
+		}, []string{"chain", "method", "result"},
+	)
+
+	CoalescedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalesced_requests_total",
+			Help: "Number of requests answered by an identical upstream call that was already in flight.",
+		}, []string{"chain"},
+	)
+
+	JWTVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "jwt_verifications_total",
+			Help: "Number of JWT access tokens checked by issuer and result (ok, expired or invalid).",
+		}, []string{"issuer", "result"},
+	)
+
+	ResponseCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "response_cache_bytes",
+			Help: "Approximate size of the JSON-RPC response cache in bytes.",
+		},
+	)
 )
 
 func InitPrometheusMetrics() {
 	prometheus.MustRegister(MetricRequestsAPI)
 	prometheus.MustRegister(MetricAPICache)
+	prometheus.MustRegister(StaleAPIKeys)
 	prometheus.MustRegister(RequestsTotal)
+	prometheus.MustRegister(ComputeUnits)
+	prometheus.MustRegister(ConfigReloads)
+	prometheus.MustRegister(ConfigLastReload)
+	prometheus.MustRegister(UpstreamHealthy)
+	prometheus.MustRegister(UpstreamBlockHeight)
+	prometheus.MustRegister(UpstreamBlockLag)
+	prometheus.MustRegister(UpstreamCircuitState)
+	prometheus.MustRegister(UpstreamCircuitTransitions)
+	prometheus.MustRegister(ResponseCacheRequests)
+	prometheus.MustRegister(ResponseCacheBytes)
+	prometheus.MustRegister(CoalescedRequests)
+	prometheus.MustRegister(JWTVerifications)
 }
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+
+	"proxy/jsonrpc"
+	"proxy/upstream"
+)
+
+// splitBatch cuts a JSON-RPC batch into chunks of at most size calls. It
+// returns nil if body is not a batch larger than size, or size is 0.
+func splitBatch(body []byte, size int) [][]jsonrpc.Request {
+	if size <= 0 {
+		return nil
+	}
+	calls, batch, err := jsonrpc.Parse(body)
+	if err != nil || !batch || len(calls) <= size {
+		return nil
+	}
+
+	chunks := make([][]jsonrpc.Request, 0, (len(calls)+size-1)/size)
+	for len(calls) > 0 {
+		n := min(size, len(calls))
+		chunks = append(chunks, calls[:n])
+		calls = calls[n:]
+	}
+	return chunks
+}
+
+// forwardBatch sends each chunk to an upstream of its own, in parallel, and
+// reassembles the replies in the order of the original batch. A chunk that
+// fails is answered with JSON-RPC errors rather than failing the whole batch.
+func forwardBatch(proxyCtx context.Context, chainCode *upstream.Chain, req *fasthttp.Request, path string, chunks [][]jsonrpc.Request) (*fasthttp.Response, error) {
+	results := make([][]jsonrpc.Response, len(chunks))
+
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = forwardChunk(proxyCtx, chainCode, req, path, chunk)
+		}()
+	}
+	wg.Wait()
+
+	var merged []jsonrpc.Response
+	for _, r := range results {
+		merged = append(merged, r...)
+	}
+
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(fasthttp.StatusOK)
+	resp.Header.SetContentType("application/json")
+	resp.SetBody(jsonrpc.Marshal(merged, true))
+	return resp, nil
+}
+
+func forwardChunk(proxyCtx context.Context, chainCode *upstream.Chain, req *fasthttp.Request, path string, chunk []jsonrpc.Request) []jsonrpc.Response {
+	sub := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(sub)
+
+	req.CopyTo(sub)
+	// The reply has to be decoded here, so don't let the upstream compress it
+	sub.Header.Del("Accept-Encoding")
+	body, _ := json.Marshal(chunk)
+	sub.SetBody(body)
+
+	resp, err := forward(proxyCtx, chainCode, sub, path)
+	if err != nil {
+		return jsonrpc.ErrorsFor(chunk, jsonrpc.CodeInternalError, err.Error())
+	}
+	defer fasthttp.ReleaseResponse(resp)
+
+	var responses []jsonrpc.Response
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return jsonrpc.ErrorsFor(chunk, jsonrpc.CodeInternalError, fmt.Sprintf("upstream returned status %d", resp.StatusCode()))
+	}
+	if err := json.Unmarshal(resp.Body(), &responses); err != nil {
+		return jsonrpc.ErrorsFor(chunk, jsonrpc.CodeInternalError, "invalid batch response from upstream")
+	}
+	return jsonrpc.Match(chunk, responses)
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy/config"
+	"proxy/jsonrpc"
+	"proxy/metrics"
+)
+
+// responseCache holds results of immutable JSON-RPC calls. It is nil while
+// caching is disabled.
+var responseCache atomic.Pointer[ResponseCache]
+
+// ConfigureResponseCache applies the response_cache section of the config.
+// Cached entries survive a reload as long as the cache stays enabled.
+func ConfigureResponseCache(cfg config.ResponseCache) {
+	if !cfg.Enabled {
+		responseCache.Store(nil)
+		return
+	}
+	if c := responseCache.Load(); c != nil {
+		c.configure(cfg)
+		return
+	}
+	c := &ResponseCache{entries: map[string]*list.Element{}, lru: list.New()}
+	c.configure(cfg)
+	responseCache.Store(c)
+}
+
+// ResponseCache is a size-bounded LRU of JSON-RPC results keyed on chain,
+// method and normalised params
+type ResponseCache struct {
+	mu       sync.Mutex
+	rules    map[string]time.Duration
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	key     string
+	result  json.RawMessage
+	expires time.Time
+}
+
+// Block tags that move with the chain head and must never be cached
+var movingBlockTags = map[string]bool{"latest": true, "pending": true, "safe": true, "finalized": true}
+
+func (c *ResponseCache) configure(cfg config.ResponseCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = cfg.Rules
+	c.maxBytes = cfg.MaxBytes
+	c.evict()
+}
+
+// cacheableCall describes a request that may be answered from the cache
+type cacheableCall struct {
+	chain  string
+	method string
+	id     json.RawMessage
+	key    string
+	ttl    time.Duration
+}
+
+// lookup returns the cache key for body if it is a single call with a TTL
+// rule and no moving block tag in its params, or nil if it is not cacheable.
+// The path is part of the key, as some chains serve different APIs by path.
+func (c *ResponseCache) lookup(chain, path string, body []byte) *cacheableCall {
+	calls, batch, err := jsonrpc.Parse(body)
+	if err != nil || batch {
+		return nil
+	}
+	call := calls[0]
+
+	c.mu.Lock()
+	ttl, ok := c.rules[call.Method]
+	c.mu.Unlock()
+	if !ok || ttl <= 0 {
+		return nil
+	}
+
+	params, moving, ok := normaliseParams(call.Params)
+	if !ok || moving {
+		return nil
+	}
+	return &cacheableCall{
+		chain:  chain,
+		method: call.Method,
+		id:     call.ID,
+		key:    chain + "|" + path + "|" + call.Method + "|" + params,
+		ttl:    ttl,
+	}
+}
+
+// get returns the cached reply to call, rewritten to carry the caller's id
+func (c *ResponseCache) get(call *cacheableCall) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[call.key]
+	if ok && time.Now().After(el.Value.(*cacheEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	var result json.RawMessage
+	if ok {
+		c.lru.MoveToFront(el)
+		result = el.Value.(*cacheEntry).result
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		metrics.ResponseCacheRequests.WithLabelValues(call.chain, call.method, "miss").Inc()
+		return nil, false
+	}
+	metrics.ResponseCacheRequests.WithLabelValues(call.chain, call.method, "hit").Inc()
+	return jsonrpc.Marshal([]jsonrpc.Response{{JSONRPC: "2.0", ID: idOrNull(call.id), Result: result}}, false), true
+}
+
+// store caches the upstream reply to call. Errors, null results, such as
+// the receipt of a transaction that is not mined yet, and pending results
+// are not cached.
+func (c *ResponseCache) store(call *cacheableCall, body []byte) {
+	var resp jsonrpc.Response
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error != nil {
+		return
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" || isPending(resp.Result) {
+		return
+	}
+
+	entry := &cacheEntry{key: call.key, result: resp.Result, expires: time.Now().Add(call.ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entrySize(entry) > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[call.key]; ok {
+		c.remove(el)
+	}
+	c.entries[call.key] = c.lru.PushFront(entry)
+	c.size += entrySize(entry)
+	c.evict()
+}
+
+// evict drops least recently used entries until the cache fits maxBytes
+func (c *ResponseCache) evict() {
+	for c.size > c.maxBytes {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return
+		}
+		c.remove(oldest)
+	}
+	metrics.ResponseCacheBytes.Set(float64(c.size))
+}
+
+func (c *ResponseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entrySize(entry)
+	metrics.ResponseCacheBytes.Set(float64(c.size))
+}
+
+func entrySize(e *cacheEntry) int64 {
+	return int64(len(e.key) + len(e.result))
+}
+
+// isPending reports whether result is an object not included in a block
+// yet, such as a transaction still in the mempool. These change once mined.
+func isPending(result json.RawMessage) bool {
+	if result[0] != '{' {
+		return false
+	}
+	var fields struct {
+		BlockHash   json.RawMessage `json:"blockHash"`
+		BlockNumber json.RawMessage `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &fields); err != nil {
+		return false
+	}
+	return string(fields.BlockHash) == "null" || string(fields.BlockNumber) == "null"
+}
+
+func idOrNull(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+// normaliseParams re-encodes params with sorted object keys and lower-case
+// hex strings, so equivalent requests produce the same key. moving reports
+// whether the params reference a block tag that follows the chain head.
+func normaliseParams(raw json.RawMessage) (params string, moving bool, ok bool) {
+	if len(raw) == 0 {
+		return "[]", false, true
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", false, false
+	}
+
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case string:
+			if movingBlockTags[v] {
+				moving = true
+			}
+			if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+				return strings.ToLower(v)
+			}
+			return v
+		case []interface{}:
+			for i := range v {
+				v[i] = walk(v[i])
+			}
+			return v
+		case map[string]interface{}:
+			for k := range v {
+				v[k] = walk(v[k])
+			}
+			return v
+		default:
+			return v
+		}
+	}
+
+	out, err := json.Marshal(walk(v))
+	if err != nil {
+		return "", false, false
+	}
+	return string(out), moving, true
+}
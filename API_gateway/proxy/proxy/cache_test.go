@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+func newTestCache() *ResponseCache {
+	c := &ResponseCache{entries: map[string]*list.Element{}, lru: list.New()}
+	c.configure(config.ResponseCache{Enabled: true, MaxBytes: 1 << 20, Rules: map[string]time.Duration{"eth_chainId": time.Hour}})
+	return c
+}
+
+func TestResponseCacheKeysOnPath(t *testing.T) {
+	c := newTestCache()
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`)
+
+	cChain := c.lookup("avax", "/ext/bc/C/rpc", body)
+	if cChain == nil {
+		t.Fatal("call is not cacheable")
+	}
+	c.store(cChain, []byte(`{"jsonrpc":"2.0","id":1,"result":"0xa86a"}`))
+
+	if _, ok := c.get(c.lookup("avax", "/ext/bc/C/rpc", body)); !ok {
+		t.Error("same path missed the cache")
+	}
+	if _, ok := c.get(c.lookup("avax", "/ext/bc/X", body)); ok {
+		t.Error("another path was answered from the cache")
+	}
+}
+
+func TestResponseCacheSkipsPendingResults(t *testing.T) {
+	c := newTestCache()
+	c.configure(config.ResponseCache{Enabled: true, MaxBytes: 1 << 20, Rules: map[string]time.Duration{"eth_getTransactionByHash": time.Minute}})
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionByHash","params":["0xabc"]}`)
+
+	tests := []struct {
+		name   string
+		reply  string
+		cached bool
+	}{
+		{"null", `{"jsonrpc":"2.0","id":1,"result":null}`, false},
+		{"error", `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`, false},
+		{"pending", `{"jsonrpc":"2.0","id":1,"result":{"hash":"0xabc","blockHash":null,"blockNumber":null}}`, false},
+		{"pending without a block hash", `{"jsonrpc":"2.0","id":1,"result":{"hash":"0xabc","blockNumber":null}}`, false},
+		{"mined", `{"jsonrpc":"2.0","id":1,"result":{"hash":"0xabc","blockHash":"0x01","blockNumber":"0x10"}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call := c.lookup("ethereum", "/", body)
+			c.store(call, []byte(tt.reply))
+			if _, ok := c.get(call); ok != tt.cached {
+				t.Errorf("cached = %v, want %v", ok, tt.cached)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+
+	"proxy/jsonrpc"
+	"proxy/metrics"
+	"proxy/upstream"
+	"proxy/utils"
+)
+
+// sharedReply is an upstream reply handed to every caller of a coalesced call
+type sharedReply struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+var inflight utils.Group[*sharedReply]
+
+// readOnlyMethods may be coalesced besides the get* methods of any namespace
+var readOnlyMethods = map[string]bool{
+	"eth_blockNumber":          true,
+	"eth_call":                 true,
+	"eth_chainId":              true,
+	"eth_estimateGas":          true,
+	"eth_feeHistory":           true,
+	"eth_gasPrice":             true,
+	"eth_maxPriorityFeePerGas": true,
+	"eth_blobBaseFee":          true,
+	"eth_syncing":              true,
+	"net_version":              true,
+	"web3_clientVersion":       true,
+	"isBlockhashValid":         true,
+	"minimumLedgerSlot":        true,
+}
+
+// coalescable reports whether calls of method may share an upstream reply:
+// read-only methods whose result doesn't depend on the caller. Anything with
+// side effects or per-caller state, such as eth_sendRawTransaction or
+// eth_newFilter and the filter polls, always gets its own round-trip.
+func coalescable(method string) bool {
+	if readOnlyMethods[method] {
+		return true
+	}
+	if strings.HasPrefix(method, "eth_getFilter") {
+		return false
+	}
+	if _, name, ok := strings.Cut(method, "_"); ok {
+		method = name
+	}
+	return strings.HasPrefix(method, "get")
+}
+
+// coalesceKey returns the key under which identical single JSON-RPC calls
+// share one upstream round-trip, along with the caller's id. It returns an
+// empty key for batches, notifications, methods that are not coalescable
+// and bodies that are not JSON-RPC.
+func coalesceKey(chain, path string, body []byte) (string, json.RawMessage) {
+	calls, batch, err := jsonrpc.Parse(body)
+	if err != nil || batch || len(calls[0].ID) == 0 || !coalescable(calls[0].Method) {
+		return "", nil
+	}
+	params, _, ok := normaliseParams(calls[0].Params)
+	if !ok {
+		return "", nil
+	}
+	return chain + "|" + path + "|" + calls[0].Method + "|" + params, calls[0].ID
+}
+
+// forwardShared forwards req unless an identical call is already in flight,
+// in which case it waits for that call's reply. The reply is rewritten to
+// carry id.
+func forwardShared(chainCode *upstream.Chain, req *fasthttp.Request, path, key string, id json.RawMessage) (*fasthttp.Response, error) {
+	reply, err, joined := inflight.Do(key, func() (*sharedReply, error) {
+		sub := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(sub)
+
+		req.CopyTo(sub)
+		// The reply is rewritten per caller, so don't let the upstream compress it
+		sub.Header.Del("Accept-Encoding")
+
+		// Not bound to any one caller, so a client that gives up doesn't fail the others
+		resp, err := forward(context.Background(), chainCode, sub, path)
+		if err != nil {
+			return nil, err
+		}
+		defer fasthttp.ReleaseResponse(resp)
+
+		return &sharedReply{
+			status:      resp.StatusCode(),
+			contentType: string(resp.Header.ContentType()),
+			body:        append([]byte(nil), resp.Body()...),
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if joined {
+		metrics.CoalescedRequests.WithLabelValues(chainCode.Name).Inc()
+	}
+
+	resp := fasthttp.AcquireResponse()
+	resp.SetStatusCode(reply.status)
+	resp.Header.SetContentType(reply.contentType)
+	resp.SetBody(withID(reply.body, id))
+	return resp, nil
+}
+
+// withID returns body with its JSON-RPC id replaced, or body unchanged if it
+// is not a single JSON-RPC reply
+func withID(body []byte, id json.RawMessage) []byte {
+	var resp jsonrpc.Response
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.ID) == 0 {
+		return body
+	}
+	resp.ID = id
+	return jsonrpc.Marshal([]jsonrpc.Response{resp}, false)
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import "testing"
+
+func TestCoalesceKey(t *testing.T) {
+	tests := []struct {
+		method    string
+		coalesced bool
+	}{
+		{"eth_blockNumber", true},
+		{"eth_getBalance", true},
+		{"eth_call", true},
+		{"getSlot", true},
+		{"getAccountInfo", true},
+		{"eth_newFilter", false},
+		{"eth_newBlockFilter", false},
+		{"eth_newPendingTransactionFilter", false},
+		{"eth_uninstallFilter", false},
+		{"eth_getFilterChanges", false},
+		{"eth_getFilterLogs", false},
+		{"eth_sendRawTransaction", false},
+		{"eth_sendTransaction", false},
+		{"sendTransaction", false},
+		{"requestAirdrop", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			body := []byte(`{"jsonrpc":"2.0","id":1,"method":"` + tt.method + `","params":[]}`)
+			key, _ := coalesceKey("eth", "/", body)
+			if (key != "") != tt.coalesced {
+				t.Errorf("coalesced = %v, want %v", key != "", tt.coalesced)
+			}
+		})
+	}
+
+	// Notifications have no id to answer with
+	if key, _ := coalesceKey("eth", "/", []byte(`{"jsonrpc":"2.0","method":"eth_blockNumber"}`)); key != "" {
+		t.Error("notification was coalesced")
+	}
+}
@@ -9,7 +9,9 @@ import (
 
 	"github.com/valyala/fasthttp"
 
+	"proxy/database"
 	"proxy/metrics"
+	"proxy/upstream"
 	"proxy/utils"
 )
 
@@ -27,11 +29,9 @@ type ProxyError struct {
 
 func (e *ProxyError) Error() string { return e.Msg }
 
-// ProxyHttpRequest proxies an incoming request to one of the upstreams in chainMap[chain]
-func ProxyHttpRequest(ctx *fasthttp.RequestCtx, req *fasthttp.Request, chain string, chainMap map[string][]string, apiKey string, keyData map[string]interface{}) {
-	queryString := string(ctx.QueryArgs().QueryString())
-	path := utils.ExtractAdditionalPath(string(ctx.Path()), queryString)
-
+// ProxyHttpRequest proxies an incoming request to one of the healthy upstreams
+// for chain, appending path to the upstream URL
+func ProxyHttpRequest(ctx *fasthttp.RequestCtx, req *fasthttp.Request, chain, path string, pool *upstream.Pool, apiKey string, key *database.KeyInfo) {
 	// Propagate X-Forwarded-For (don’t overwrite if already set on the outgoing req)
 	if req.Header.Peek("X-Forwarded-For") == nil {
 		if xff := ctx.Request.Header.Peek("X-Forwarded-For"); len(xff) > 0 {
@@ -47,13 +47,47 @@ func ProxyHttpRequest(ctx *fasthttp.RequestCtx, req *fasthttp.Request, chain str
 	// SSE passthrough (prefer Accept header; path check kept for backward compat)
 	acceptHeader := string(ctx.Request.Header.Peek("Accept"))
 	isSSE := strings.Contains(acceptHeader, "text/event-stream") || (strings.Contains(path, "stream") && strings.Contains(strings.ToLower(chain), strings.ToLower("hermes")))
-	
+
+	chainCode := pool.Chain(chain)
+
+	// Refuse JSON-RPC methods the chain or key does not permit
+	if reply := checkMethods(req.Body(), MethodPolicyFor(chainCode, key)); reply != nil {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(reply)
+		metrics.RequestsTotal.WithLabelValues("200").Inc()
+		return
+	}
+
 	if isSSE {
-		proxySSE(chainMap[chain][0]+path, ctx, chain, apiKey, keyData)
+		if chainCode == nil {
+			utils.WriteJSONError(ctx, "failed to proxy request: invalid chain configuration", fasthttp.StatusBadRequest)
+			return
+		}
+		endpoint := chainCode.Pick(upstream.HTTP, nil)
+		if endpoint == nil {
+			utils.WriteJSONError(ctx, "no upstream available", fasthttp.StatusServiceUnavailable)
+			return
+		}
+		proxySSE(endpoint, path, ctx, chain, key)
 		return
 	}
 
-	maxRetries := 3
+	// Answer immutable calls from the response cache
+	var cacheable *cacheableCall
+	cache := responseCache.Load()
+	if cache != nil && chainCode != nil {
+		if cacheable = cache.lookup(chain, path, req.Body()); cacheable != nil {
+			if body, ok := cache.get(cacheable); ok {
+				ctx.SetStatusCode(fasthttp.StatusOK)
+				ctx.SetContentType("application/json")
+				ctx.SetBody(body)
+				metrics.RequestsTotal.WithLabelValues("200").Inc()
+				return
+			}
+		}
+	}
+
 	responseChan := make(chan *fasthttp.Response, 1)
 	errChan := make(chan error, 1)
 
@@ -65,73 +99,31 @@ func ProxyHttpRequest(ctx *fasthttp.RequestCtx, req *fasthttp.Request, chain str
 		defer close(responseChan)
 		defer close(errChan)
 
-		chainCode, ok := chainMap[chain]
-		if !ok || len(chainCode) == 0 {
+		if chainCode == nil || len(chainCode.HTTP) == 0 {
 			errChan <- &ProxyError{Msg: "failed to proxy request: invalid chain configuration", Status: fasthttp.StatusBadRequest}
 			return
 		}
 
-		var lastErr error
-
-		for attempt := 0; attempt < maxRetries; attempt++ {
-			select {
-			case <-proxyCtx.Done():
-				errChan <- &ProxyError{Msg: "request cancelled", Status: fasthttp.StatusRequestTimeout}
-				return
-			default:
-			}
-
-			uri := chainCode[attempt%len(chainCode)] + path
-
-			// Parse the full URL into the request URI
-			req.URI().Parse(nil, []byte(uri))
-			
-			// Set BOTH the request's host and the header host
-			req.URI().SetHostBytes(req.URI().Host())
-			req.SetHostBytes(req.URI().Host())          // this is the important one
-			req.Header.SetHostBytes(req.URI().Host())
-
-			backendResp := fasthttp.AcquireResponse()
-			//log.Printf("uri=%q hostHdr=%q uriHost=%q",uri, req.Header.Peek("Host"), req.URI().Host())
-			if err := client.Do(req, backendResp); err != nil {
-				// Transport error → retry
-				log.Printf("proxy network error: %s -> %v", uri, err)
-				fasthttp.ReleaseResponse(backendResp)
-				lastErr = &ProxyError{Msg: err.Error(), Status: fasthttp.StatusBadGateway}
-				continue
-			}
-
-			status := backendResp.StatusCode()
-
-			// Treat any 2xx as success
-			if status >= 200 && status < 300 {
-				responseChan <- backendResp
-				return
-			}
-
-			// Optional: retry on upstream 5xx
-			if status >= 500 && status <= 599 && attempt < maxRetries-1 {
-				log.Printf("proxy upstream %d from %s; retrying...", status, uri)
-				fasthttp.ReleaseResponse(backendResp)
-				continue
-			}
-
-			// Hand non-2xx back so caller can forward status + body to client
-			responseChan <- backendResp
-			return
-		}
-
-		if lastErr != nil {
-			errChan <- lastErr
+		var backendResp *fasthttp.Response
+		var err error
+		if chunks := splitBatch(req.Body(), chainCode.Config.BatchSplitSize); chunks != nil {
+			backendResp, err = forwardBatch(proxyCtx, chainCode, req, path, chunks)
+		} else if key, id := coalesceKey(chain, path, req.Body()); key != "" {
+			backendResp, err = forwardShared(chainCode, req, path, key, id)
 		} else {
-			errChan <- &ProxyError{Msg: "proxy failed", Status: fasthttp.StatusBadGateway}
+			backendResp, err = forward(proxyCtx, chainCode, req, path)
+		}
+		if err != nil {
+			errChan <- err
+			return
 		}
+		responseChan <- backendResp
 	}()
 
 	select {
 	case backendResp := <-responseChan:
 		if backendResp == nil {
-			ctx.Error("Error proxying request: no response received", fasthttp.StatusBadGateway)
+			utils.WriteJSONError(ctx, "Error proxying request: no response received", fasthttp.StatusBadGateway)
 			metrics.RequestsTotal.WithLabelValues("502").Inc()
 			return
 		}
@@ -141,23 +133,38 @@ func ProxyHttpRequest(ctx *fasthttp.RequestCtx, req *fasthttp.Request, chain str
 
 		// Copy all headers except hop-by-hop ones. This preserves Content-Encoding/Vary/etc.
 		hopByHop := map[string]struct{}{
-			"connection":            {},
-			"keep-alive":            {},
-			"proxy-authenticate":    {},
-			"proxy-authorization":   {},
-			"te":                    {},
-			"trailer":               {},
-			"transfer-encoding":     {},
-			"upgrade":               {},
+			"connection":          {},
+			"keep-alive":          {},
+			"proxy-authenticate":  {},
+			"proxy-authorization": {},
+			"te":                  {},
+			"trailer":             {},
+			"transfer-encoding":   {},
+			"upgrade":             {},
 		}
 
 		backendResp.Header.VisitAll(func(k, v []byte) {
 			if _, skip := hopByHop[strings.ToLower(string(k))]; skip {
 				return
 			}
+			// The gateway's own quota and CORS headers take precedence over the upstream's
+			key := strings.ToLower(string(k))
+			if strings.HasPrefix(key, "ratelimit-") || strings.HasPrefix(key, "access-control-") {
+				return
+			}
+			if key == "vary" {
+				ctx.Response.Header.AddBytesKV(k, v)
+				return
+			}
 			ctx.Response.Header.SetBytesKV(k, v)
 		})
 
+		if cacheable != nil && backendResp.StatusCode() == fasthttp.StatusOK {
+			if body, err := backendResp.BodyUncompressed(); err == nil {
+				cache.store(cacheable, body)
+			}
+		}
+
 		// Copy body before releasing the response object
 		ctx.SetBody(backendResp.Body())
 		fasthttp.ReleaseResponse(backendResp)
@@ -166,19 +173,90 @@ func ProxyHttpRequest(ctx *fasthttp.RequestCtx, req *fasthttp.Request, chain str
 
 	case err := <-errChan:
 		if proxyErr, ok := err.(*ProxyError); ok {
-			ctx.SetStatusCode(proxyErr.Status)
-			ctx.SetBodyString(proxyErr.Msg)
+			utils.WriteJSONError(ctx, proxyErr.Msg, proxyErr.Status)
 			metrics.RequestsTotal.WithLabelValues(fmt.Sprintf("%d", proxyErr.Status)).Inc()
 		} else {
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			ctx.SetBodyString("Unknown error occurred")
+			utils.WriteJSONError(ctx, "Unknown error occurred", fasthttp.StatusInternalServerError)
 			metrics.RequestsTotal.WithLabelValues("500").Inc()
 		}
 
 	case <-ctx.Done():
 		cancel()
-		ctx.SetStatusCode(fasthttp.StatusRequestTimeout)
-		ctx.SetBodyString("Request timed out")
+		utils.WriteJSONError(ctx, "Request timed out", fasthttp.StatusRequestTimeout)
 		metrics.RequestsTotal.WithLabelValues("504").Inc()
 	}
 }
+
+// forward sends req to the chain's upstreams, retrying transport errors and
+// 5xx responses on endpoints that were not tried yet. The caller releases
+// the returned response.
+func forward(proxyCtx context.Context, chainCode *upstream.Chain, req *fasthttp.Request, path string) (*fasthttp.Response, error) {
+	maxRetries := 3
+
+	var lastErr error
+	tried := make(map[*upstream.Endpoint]bool, maxRetries)
+
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		select {
+		case <-proxyCtx.Done():
+			return nil, &ProxyError{Msg: "request cancelled", Status: fasthttp.StatusRequestTimeout}
+		default:
+		}
+
+		endpoint := chainCode.Pick(upstream.HTTP, tried)
+		if endpoint == nil {
+			// Every endpoint has an open circuit; fail fast instead of waiting on a dead node
+			if lastErr == nil {
+				lastErr = &ProxyError{Msg: "no upstream available", Status: fasthttp.StatusServiceUnavailable}
+			}
+			break
+		}
+		tried[endpoint] = true
+		uri := endpoint.URL + path
+
+		// Parse the full URL into the request URI
+		req.URI().Parse(nil, []byte(uri))
+
+		// Set BOTH the request's host and the header host
+		req.URI().SetHostBytes(req.URI().Host())
+		req.SetHostBytes(req.URI().Host()) // this is the important one
+		req.Header.SetHostBytes(req.URI().Host())
+
+		backendResp := fasthttp.AcquireResponse()
+		//log.Printf("uri=%q hostHdr=%q uriHost=%q",uri, req.Header.Peek("Host"), req.URI().Host())
+		start := time.Now()
+		endpoint.Acquire()
+		err := client.Do(req, backendResp)
+		endpoint.Release()
+		endpoint.Observe(time.Since(start), err == nil && backendResp.StatusCode() < 500)
+		if err != nil {
+			// Transport error → retry
+			log.Printf("proxy network error: %s -> %v", uri, err)
+			fasthttp.ReleaseResponse(backendResp)
+			lastErr = &ProxyError{Msg: err.Error(), Status: fasthttp.StatusBadGateway}
+			continue
+		}
+
+		status := backendResp.StatusCode()
+
+		// Treat any 2xx as success
+		if status >= 200 && status < 300 {
+			return backendResp, nil
+		}
+
+		// Optional: retry on upstream 5xx
+		if status >= 500 && status <= 599 && attempt < maxRetries-1 {
+			log.Printf("proxy upstream %d from %s; retrying...", status, uri)
+			fasthttp.ReleaseResponse(backendResp)
+			continue
+		}
+
+		// Hand non-2xx back so caller can forward status + body to client
+		return backendResp, nil
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, &ProxyError{Msg: "proxy failed", Status: fasthttp.StatusBadGateway}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"fmt"
+
+	"proxy/config"
+	"proxy/database"
+	"proxy/jsonrpc"
+	"proxy/upstream"
+)
+
+// MethodPolicyFor returns the chain's method policy with the key's own
+// allow/deny lists taking precedence
+func MethodPolicyFor(chain *upstream.Chain, key *database.KeyInfo) config.MethodPolicy {
+	var policy config.MethodPolicy
+	if chain != nil {
+		policy = chain.Config.Methods
+	}
+	return policy.Override(config.MethodPolicy{
+		Allow: key.AllowedMethods,
+		Deny:  key.DeniedMethods,
+	})
+}
+
+// checkMethods returns a JSON-RPC error reply if body calls a method the
+// policy does not permit, or nil if it may be forwarded. In a batch every
+// call is answered, so clients can tell which method was refused. Under a
+// policy, JSON bodies that don't parse are refused as a whole: upstreams
+// may still run the calls in them, e.g. ahead of trailing garbage.
+func checkMethods(body []byte, policy config.MethodPolicy) []byte {
+	calls, batch, err := jsonrpc.Parse(body)
+	if err != nil {
+		if policy.IsEmpty() || !jsonrpc.LooksLikeJSON(body) {
+			return nil
+		}
+		return jsonrpc.Marshal([]jsonrpc.Response{jsonrpc.ErrorResponse(nil, jsonrpc.CodeInvalidRequest, "invalid JSON-RPC request")}, false)
+	}
+
+	refused := false
+	responses := make([]jsonrpc.Response, len(calls))
+	for i, call := range calls {
+		if policy.Permits(call.Method) {
+			responses[i] = jsonrpc.ErrorResponse(call.ID, jsonrpc.CodeInvalidRequest, "batch rejected: it contains a method that is not allowed")
+			continue
+		}
+		refused = true
+		responses[i] = jsonrpc.ErrorResponse(call.ID, jsonrpc.CodeMethodNotAllowed, fmt.Sprintf("method %s is not allowed", call.Method))
+	}
+
+	if !refused {
+		return nil
+	}
+	return jsonrpc.Marshal(responses, batch)
+}
+
+// MethodFilter returns a WebSocket frame inspector enforcing policy
+func MethodFilter(policy config.MethodPolicy) func(message []byte) []byte {
+	return func(message []byte) []byte {
+		return checkMethods(message, policy)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"proxy/config"
+	"proxy/jsonrpc"
+)
+
+func TestCheckMethods(t *testing.T) {
+	policy := config.MethodPolicy{Deny: []string{"debug_*"}}
+	denied := `{"jsonrpc":"2.0","id":1,"method":"debug_traceTransaction","params":["0xabc"]}`
+
+	tests := []struct {
+		name   string
+		policy config.MethodPolicy
+		body   string
+		code   int // expected error code of the first response, 0 if forwarded
+	}{
+		{"allowed call", policy, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`, 0},
+		{"denied call", policy, denied, jsonrpc.CodeMethodNotAllowed},
+		{"denied call in batch", policy, `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},` + denied + `]`, jsonrpc.CodeInvalidRequest},
+		{"denied call with trailing bytes", policy, denied + ` x`, jsonrpc.CodeInvalidRequest},
+		{"batch entry without method", policy, `[` + denied + `,{"id":2}]`, jsonrpc.CodeInvalidRequest},
+		{"truncated batch", policy, `[` + denied, jsonrpc.CodeInvalidRequest},
+		{"non-JSON body", policy, `hello`, 0},
+		{"malformed body without policy", config.MethodPolicy{}, denied + ` x`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := checkMethods([]byte(tt.body), tt.policy)
+			if tt.code == 0 {
+				if reply != nil {
+					t.Fatalf("expected body to be forwarded, got %s", reply)
+				}
+				return
+			}
+			if reply == nil {
+				t.Fatal("expected body to be refused")
+			}
+
+			var resp jsonrpc.Response
+			if reply[0] == '[' {
+				var batch []jsonrpc.Response
+				if err := json.Unmarshal(reply, &batch); err != nil || len(batch) == 0 {
+					t.Fatalf("bad reply %s: %v", reply, err)
+				}
+				resp = batch[0]
+			} else if err := json.Unmarshal(reply, &resp); err != nil {
+				t.Fatalf("bad reply %s: %v", reply, err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.code {
+				t.Errorf("reply %s, want error code %d", reply, tt.code)
+			}
+		})
+	}
+}
+
+func TestMethodFilterRefusesMalformedFrames(t *testing.T) {
+	filter := MethodFilter(config.MethodPolicy{Deny: []string{"debug_*"}})
+	frame := `[{"jsonrpc":"2.0","id":1,"method":"debug_traceTransaction"},{"id":2}]`
+	if filter([]byte(frame)) == nil {
+		t.Errorf("frame %s was let through", frame)
+	}
+}
@@ -10,7 +10,10 @@ import (
 	"strings"
 	"time"
 
+	"proxy/database"
 	"proxy/metrics"
+	"proxy/upstream"
+	"proxy/utils"
 
 	"github.com/valyala/fasthttp"
 )
@@ -20,18 +23,20 @@ const (
 	maxEventSize       = 4 * 1024 * 1024 // 4MB safety cap
 )
 
-func proxySSE(target string, ctx *fasthttp.RequestCtx, chain string, apikey string, keyData map[string]interface{}) {
-	parsedURL, err := url.Parse(target)
+func proxySSE(endpoint *upstream.Endpoint, path string, ctx *fasthttp.RequestCtx, chain string, key *database.KeyInfo) {
+	parsedURL, err := url.Parse(endpoint.URL + path)
 	if err != nil {
 		log.Println("Invalid target URL:", err)
-		ctx.Error("Invalid target URL", fasthttp.StatusInternalServerError)
+		utils.WriteJSONError(ctx, "Invalid target URL", fasthttp.StatusInternalServerError)
 		return
 	}
 
+	start := time.Now()
 	conn, err := net.Dial("tcp", parsedURL.Host)
+	endpoint.Observe(time.Since(start), err == nil)
 	if err != nil {
 		log.Println("Failed to connect upstream:", err)
-		ctx.Error("Failed to connect upstream", fasthttp.StatusBadGateway)
+		utils.WriteJSONError(ctx, "Failed to connect upstream", fasthttp.StatusBadGateway)
 		return
 	}
 
@@ -53,7 +58,10 @@ func proxySSE(target string, ctx *fasthttp.RequestCtx, chain string, apikey stri
 	ctx.Response.Header.Set("X-Accel-Buffering", "no")
 	ctx.Response.Header.Del("Content-Length")
 
+	// The stream counts as in flight on the endpoint for as long as it is open
+	endpoint.Acquire()
 	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer endpoint.Release()
 		defer conn.Close()
 
 		reader := bufio.NewReaderSize(conn, upstreamReaderSize)
@@ -72,10 +80,10 @@ func proxySSE(target string, ctx *fasthttp.RequestCtx, chain string, apikey stri
 
 		metrics.RequestsTotal.WithLabelValues("200").Inc()
 		metrics.MetricRequestsAPI.WithLabelValues(
-			apikey,
-			keyData["org"].(string),
-			keyData["org_id"].(string),
-			keyData["chain"].(string),
+			key.ID,
+			key.Org,
+			key.OrgID,
+			chain,
 			"200",
 		).Inc()
 
@@ -121,10 +129,10 @@ func proxySSE(target string, ctx *fasthttp.RequestCtx, chain string, apikey stri
 
 				metrics.RequestsTotal.WithLabelValues("200").Inc()
 				metrics.MetricRequestsAPI.WithLabelValues(
-					apikey,
-					keyData["org"].(string),
-					keyData["org_id"].(string),
-					keyData["chain"].(string),
+					key.ID,
+					key.Org,
+					key.OrgID,
+					chain,
 					"200",
 				).Inc()
 
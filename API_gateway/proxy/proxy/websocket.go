@@ -3,6 +3,7 @@ package proxy
 import (
 	"log"
 
+	"proxy/database"
 	"proxy/metrics"
 	"strconv"
 	"sync"
@@ -10,10 +11,13 @@ import (
 	"github.com/fasthttp/websocket"
 )
 
-func ProxyWebSocketMessages(src, dst *websocket.Conn, apiKey string, keyData map[string]interface{}, done chan struct{}, writeMutex *sync.Mutex) {
+// ProxyWebSocketMessages copies frames from src to dst until either side
+// fails. If inspect is set it is called for every frame; a non-nil reply is
+// sent back to src instead of forwarding the frame.
+func ProxyWebSocketMessages(src, dst *websocket.Conn, chain string, key *database.KeyInfo, done chan struct{}, writeMutex *sync.Mutex, inspect func(message []byte) []byte) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered from panic in WebSocket proxy (backend: %s): %v", apiKey, r)
+			log.Printf("Recovered from panic in WebSocket proxy (key: %s): %v", key.ID, r)
 		}
 	}()
 
@@ -29,8 +33,15 @@ func ProxyWebSocketMessages(src, dst *websocket.Conn, apiKey string, keyData map
 				return
 			}
 
+			target := dst
+			if inspect != nil {
+				if reply := inspect(message); reply != nil {
+					target, message = src, reply
+				}
+			}
+
 			writeMutex.Lock()
-			err = dst.WriteMessage(messageType, message)
+			err = target.WriteMessage(messageType, message)
 			writeMutex.Unlock()
 			if err != nil {
 				log.Printf("Error writing message: %s", err)
@@ -39,7 +50,7 @@ func ProxyWebSocketMessages(src, dst *websocket.Conn, apiKey string, keyData map
 			}
 
 			// Log
-			metrics.MetricRequestsAPI.WithLabelValues(apiKey, keyData["org"].(string), keyData["org_id"].(string), keyData["chain"].(string), strconv.Itoa(100)).Inc()
+			metrics.MetricRequestsAPI.WithLabelValues(key.ID, key.Org, key.OrgID, chain, strconv.Itoa(100)).Inc()
 		}
 	}
 }
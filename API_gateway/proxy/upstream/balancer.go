@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Balancer picks one endpoint out of the candidates currently in rotation
+type Balancer interface {
+	Pick(candidates []*Endpoint) *Endpoint
+}
+
+// NewBalancer returns the strategy registered under name, defaulting to round robin
+func NewBalancer(name string) Balancer {
+	switch name {
+	case "weighted":
+		return weighted{}
+	case "least_in_flight":
+		return &leastInFlight{}
+	case "ewma":
+		return &ewma{}
+	default:
+		return &roundRobin{}
+	}
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobin) Pick(candidates []*Endpoint) *Endpoint {
+	return candidates[b.next.Add(1)%uint64(len(candidates))]
+}
+
+// weighted picks at random in proportion to each endpoint's configured weight
+type weighted struct{}
+
+func (weighted) Pick(candidates []*Endpoint) *Endpoint {
+	total := 0
+	for _, e := range candidates {
+		total += e.Weight()
+	}
+
+	n := rand.IntN(total)
+	for _, e := range candidates {
+		if n < e.Weight() {
+			return e
+		}
+		n -= e.Weight()
+	}
+	return candidates[len(candidates)-1]
+}
+
+// leastInFlight picks the endpoint with the fewest outstanding requests.
+// Ties are broken round robin so idle endpoints share the load.
+type leastInFlight struct {
+	offset atomic.Uint64
+}
+
+func (b *leastInFlight) Pick(candidates []*Endpoint) *Endpoint {
+	start := int(b.offset.Add(1) % uint64(len(candidates)))
+
+	var best *Endpoint
+	for i := range candidates {
+		e := candidates[(start+i)%len(candidates)]
+		if best == nil || e.InFlight() < best.InFlight() {
+			best = e
+		}
+	}
+	return best
+}
+
+// ewma picks the endpoint with the lowest smoothed latency, scaled by its
+// outstanding requests so a fast endpoint is not buried under all traffic.
+// Endpoints without a measurement yet are tried first.
+type ewma struct {
+	offset atomic.Uint64
+}
+
+func (b *ewma) Pick(candidates []*Endpoint) *Endpoint {
+	start := int(b.offset.Add(1) % uint64(len(candidates)))
+
+	var best *Endpoint
+	var bestScore float64
+	for i := range candidates {
+		e := candidates[(start+i)%len(candidates)]
+		latency := e.Latency()
+		if latency == 0 {
+			return e
+		}
+		score := float64(latency) * float64(e.InFlight()+1)
+		if best == nil || score < bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"proxy/config"
+	"proxy/metrics"
+)
+
+type BreakerState int
+
+const (
+	Closed BreakerState = iota
+	HalfOpen
+	Open
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case HalfOpen:
+		return "half_open"
+	case Open:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a per-endpoint circuit breaker driven by consecutive failures
+// and the error rate over a fixed window.
+type breaker struct {
+	mu       sync.Mutex
+	settings config.CircuitBreaker
+
+	state       BreakerState
+	openedAt    time.Time
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int // trial requests in flight while half open
+}
+
+func (b *breaker) configure(settings config.CircuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settings = settings
+}
+
+// available reports whether a request could currently be let through,
+// without reserving a half-open trial slot.
+func (b *breaker) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		return now.Sub(b.openedAt) >= b.settings.OpenFor
+	case HalfOpen:
+		return b.probes < b.settings.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// allow reserves the right to send a request. While half open only a
+// limited number of trial requests are admitted.
+func (b *breaker) allow(e *Endpoint, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open {
+		if now.Sub(b.openedAt) < b.settings.OpenFor {
+			return false
+		}
+		b.transition(e, HalfOpen, now)
+	}
+	if b.state == HalfOpen {
+		if b.probes >= b.settings.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record feeds the outcome of a request into the breaker
+func (b *breaker) record(e *Endpoint, ok bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HalfOpen {
+		if b.probes > 0 {
+			b.probes--
+		}
+		if ok {
+			b.transition(e, Closed, now)
+		} else {
+			b.transition(e, Open, now)
+		}
+		return
+	}
+	if b.state == Open {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.settings.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+
+	if ok {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.consecutive >= b.settings.ConsecutiveFailures ||
+		(b.requests >= b.settings.MinRequests && float64(b.failures)/float64(b.requests) >= b.settings.ErrorRate) {
+		b.transition(e, Open, now)
+	}
+}
+
+func (b *breaker) transition(e *Endpoint, to BreakerState, now time.Time) {
+	if b.state == to {
+		return
+	}
+	log.Printf("Upstream %s/%s %s circuit %s -> %s", e.Chain, e.Transport, e.Label(), b.state, to)
+
+	b.state = to
+	b.consecutive, b.requests, b.failures, b.probes = 0, 0, 0, 0
+	b.windowStart = now
+	if to == Open {
+		b.openedAt = now
+	}
+
+	metrics.UpstreamCircuitState.WithLabelValues(e.Chain, e.Transport, e.Label()).Set(float64(to))
+	metrics.UpstreamCircuitTransitions.WithLabelValues(e.Chain, e.Transport, e.Label(), to.String()).Inc()
+}
+
+func (b *breaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
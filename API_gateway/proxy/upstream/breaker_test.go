@@ -0,0 +1,162 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+// breakerStep advances the clock and feeds the breaker one event: a request
+// it is asked to allow, or the outcome of one
+type breakerStep struct {
+	advance time.Duration
+	event   string // "allow", "ok" or "fail"
+	allowed bool   // expected result of allow
+	state   BreakerState
+}
+
+func TestBreaker(t *testing.T) {
+	settings := config.CircuitBreaker{
+		ConsecutiveFailures: 3,
+		ErrorRate:           0.75,
+		MinRequests:         4,
+		Window:              time.Minute,
+		OpenFor:             30 * time.Second,
+		HalfOpenRequests:    1,
+	}
+
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "consecutive failures open the circuit",
+			steps: []breakerStep{
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Open},
+				{time.Second, "allow", false, Open},
+			},
+		},
+		{
+			name: "a success resets the failure streak",
+			steps: []breakerStep{
+				{0, "ok", false, Closed},
+				{0, "ok", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "ok", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+			},
+		},
+		{
+			name: "error rate opens the circuit once enough requests were seen",
+			steps: []breakerStep{
+				{0, "fail", false, Closed},
+				{0, "ok", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Open}, // 3 of 4 failed, though never 3 in a row
+			},
+		},
+		{
+			name: "error rate window restarts",
+			steps: []breakerStep{
+				{0, "fail", false, Closed},
+				{0, "ok", false, Closed},
+				{0, "fail", false, Closed},
+				{time.Minute, "ok", false, Closed}, // new window: 0 of 1 failed
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "ok", false, Closed},
+				{0, "fail", false, Closed}, // 3 of 5 failed
+			},
+		},
+		{
+			name: "cooldown then a successful probe closes the circuit",
+			steps: []breakerStep{
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Open},
+				{29 * time.Second, "allow", false, Open},
+				{time.Second, "allow", true, HalfOpen},
+				{0, "allow", false, HalfOpen}, // only one probe at a time
+				{0, "ok", false, Closed},
+				{0, "allow", true, Closed},
+			},
+		},
+		{
+			name: "a failed probe reopens the circuit for another cooldown",
+			steps: []breakerStep{
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Open},
+				{30 * time.Second, "allow", true, HalfOpen},
+				{time.Second, "fail", false, Open},
+				{29 * time.Second, "allow", false, Open},
+				{time.Second, "allow", true, HalfOpen},
+			},
+		},
+		{
+			name: "the circuit closes with a clean slate",
+			steps: []breakerStep{
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Open},
+				{30 * time.Second, "allow", true, HalfOpen},
+				{0, "ok", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Closed},
+				{0, "fail", false, Open},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEndpoint("ethereum", HTTP, config.Endpoint{URL: "https://node.example.com"})
+			e.breaker.configure(settings)
+			now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+			for i, step := range tt.steps {
+				now = now.Add(step.advance)
+				switch step.event {
+				case "allow":
+					if got := e.breaker.allow(e, now); got != step.allowed {
+						t.Errorf("step %d: allow = %v, want %v", i, got, step.allowed)
+					}
+				case "ok", "fail":
+					e.breaker.record(e, step.event == "ok", now)
+				}
+				if got := e.breaker.current(); got != step.state {
+					t.Fatalf("step %d (%s): state %s, want %s", i, step.event, got, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerAvailable(t *testing.T) {
+	e := newEndpoint("ethereum", HTTP, config.Endpoint{URL: "https://node.example.com"})
+	e.breaker.configure(config.CircuitBreaker{ConsecutiveFailures: 1, Window: time.Minute, MinRequests: 10, ErrorRate: 1, OpenFor: 10 * time.Second, HalfOpenRequests: 2})
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	e.breaker.record(e, false, now)
+	if e.breaker.available(now.Add(9 * time.Second)) {
+		t.Error("open circuit available before its cooldown")
+	}
+	// available does not take a probe slot, allow does
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		if !e.breaker.available(now) {
+			t.Fatalf("circuit unavailable after its cooldown (check %d)", i)
+		}
+	}
+	if !e.breaker.allow(e, now) || !e.breaker.allow(e, now) {
+		t.Fatal("half-open circuit refused its two probes")
+	}
+	if e.breaker.available(now) || e.breaker.allow(e, now) {
+		t.Error("half-open circuit admitted a third probe")
+	}
+}
@@ -0,0 +1,190 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+
+	"proxy/metrics"
+)
+
+var probeClient = &fasthttp.Client{
+	MaxConnsPerHost: 4,
+	ReadTimeout:     10 * time.Second,
+	WriteTimeout:    10 * time.Second,
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// RunHealthChecks probes every endpoint in the pool on its chain type's
+// interval and takes endpoints in and out of rotation. It blocks forever.
+func RunHealthChecks(pool *Pool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().UnixNano()
+		for _, c := range pool.Chains() {
+			for _, e := range c.all() {
+				if now < e.nextCheck || !e.checking.CompareAndSwap(false, true) {
+					continue
+				}
+				e.nextCheck = now + c.Health.Interval.Nanoseconds()
+				go check(c, e)
+			}
+			updateLag(c)
+		}
+	}
+}
+
+// updateLag refreshes the per-endpoint lag gauges against the chain leader
+func updateLag(c *Chain) {
+	leader := c.Leader()
+	for _, e := range c.all() {
+		if h := e.Height(); h != 0 && leader >= h {
+			metrics.UpstreamBlockLag.WithLabelValues(e.Chain, e.Transport, e.Label()).Set(float64(leader - h))
+		}
+	}
+}
+
+func check(c *Chain, e *Endpoint) {
+	defer e.checking.Store(false)
+
+	probe := probeHTTP
+	if e.Transport == WS {
+		probe = probeWS
+	}
+
+	result, err := probe(e.URL, c.Health.Method, c.Health.Timeout)
+	if err == nil && c.Health.HeightMethod != "" {
+		if c.Health.HeightMethod != c.Health.Method {
+			result, err = probe(e.URL, c.Health.HeightMethod, c.Health.Timeout)
+		}
+		if err == nil {
+			var height uint64
+			if height, err = parseHeight(result); err == nil {
+				e.setHeight(height)
+			}
+		}
+	}
+
+	if err != nil {
+		e.okStreak = 0
+		e.failStreak++
+		if e.Healthy() && e.failStreak >= c.Health.Failures {
+			log.Printf("Upstream %s/%s %s marked unhealthy: %v", e.Chain, e.Transport, e.Label(), err)
+			e.setHealthy(false)
+		}
+		return
+	}
+
+	e.failStreak = 0
+	e.okStreak++
+	if !e.Healthy() && e.okStreak >= c.Health.Successes {
+		log.Printf("Upstream %s/%s %s recovered", e.Chain, e.Transport, e.Label())
+		e.setHealthy(true)
+	}
+}
+
+func rpcRequest(method string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  []interface{}{},
+	})
+	return body
+}
+
+func checkRPCResponse(body []byte) (json.RawMessage, error) {
+	var resp rpcResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if len(resp.Error) > 0 && string(resp.Error) != "null" {
+		return nil, fmt.Errorf("rpc error: %s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// parseHeight accepts a hex quantity ("0x1b4", EVM) or a plain number (Solana slot)
+func parseHeight(result json.RawMessage) (uint64, error) {
+	var s string
+	if err := json.Unmarshal(result, &s); err == nil {
+		if !strings.HasPrefix(s, "0x") {
+			return 0, fmt.Errorf("unexpected height %q", s)
+		}
+		return strconv.ParseUint(s[2:], 16, 64)
+	}
+
+	var n uint64
+	if err := json.Unmarshal(result, &n); err != nil {
+		return 0, fmt.Errorf("unexpected height %s", result)
+	}
+	return n, nil
+}
+
+func probeHTTP(url, method string, timeout time.Duration) (json.RawMessage, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(url)
+	if method != "" {
+		req.Header.SetMethod(fasthttp.MethodPost)
+		req.Header.SetContentType("application/json")
+		req.SetBody(rpcRequest(method))
+	} else {
+		req.Header.SetMethod(fasthttp.MethodGet)
+	}
+
+	if err := probeClient.DoTimeout(req, resp, timeout); err != nil {
+		return nil, err
+	}
+
+	status := resp.StatusCode()
+	if method == "" {
+		if status >= 500 {
+			return nil, fmt.Errorf("status %d", status)
+		}
+		return nil, nil
+	}
+	if status != fasthttp.StatusOK {
+		return nil, fmt.Errorf("status %d", status)
+	}
+	return checkRPCResponse(resp.Body())
+}
+
+func probeWS(url, method string, timeout time.Duration) (json.RawMessage, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: timeout}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if method == "" {
+		return nil, nil
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := conn.WriteMessage(websocket.TextMessage, rpcRequest(method)); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return checkRPCResponse(msg)
+}
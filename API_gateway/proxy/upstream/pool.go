@@ -0,0 +1,361 @@
+package upstream
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy/config"
+	"proxy/metrics"
+)
+
+const (
+	HTTP = "http"
+	WS   = "ws"
+)
+
+// Endpoint is a single upstream URL together with its runtime state. The
+// same Endpoint is carried across config reloads as long as its chain,
+// transport and URL are unchanged, so health, circuit and latency history is
+// not lost; a new weight or name is applied to it in place.
+type Endpoint struct {
+	Chain     string
+	Transport string
+	URL       string
+
+	label    atomic.Pointer[string]
+	weight   atomic.Int64
+	healthy  atomic.Bool
+	height   atomic.Uint64 // latest block/slot reported by the health checker, 0 if unknown
+	inFlight atomic.Int64
+	latency  atomic.Int64 // EWMA of successful request latency in nanoseconds
+	breaker  breaker
+
+	// Only touched by the health checker
+	checking   atomic.Bool
+	nextCheck  int64 // unix nanos
+	failStreak int
+	okStreak   int
+}
+
+func newEndpoint(chain, transport string, ep config.Endpoint) *Endpoint {
+	e := &Endpoint{Chain: chain, Transport: transport, URL: ep.URL}
+	label := ep.Label()
+	e.label.Store(&label)
+	e.weight.Store(int64(max(ep.Weight, 1)))
+	e.setHealthy(true)
+	metrics.UpstreamCircuitState.WithLabelValues(chain, transport, label).Set(float64(Closed))
+	return e
+}
+
+// Label identifies the endpoint in logs and metrics
+func (e *Endpoint) Label() string {
+	return *e.label.Load()
+}
+
+// Weight is the endpoint's relative share for the weighted balancer
+func (e *Endpoint) Weight() int {
+	return int(e.weight.Load())
+}
+
+// reconfigure applies the weight and name of ep, which has the endpoint's
+// URL, keeping its state. Under a new label the gauges are republished.
+func (e *Endpoint) reconfigure(ep config.Endpoint) {
+	e.weight.Store(int64(max(ep.Weight, 1)))
+	label := ep.Label()
+	if label == e.Label() {
+		return
+	}
+	e.label.Store(&label)
+	e.setHealthy(e.Healthy())
+	if h := e.Height(); h > 0 {
+		e.setHeight(h)
+	}
+	metrics.UpstreamCircuitState.WithLabelValues(e.Chain, e.Transport, label).Set(float64(e.Circuit()))
+}
+
+// ewmaAlpha is the weight given to each new latency sample
+const ewmaAlpha = 0.2
+
+// Acquire marks a request or connection to the endpoint as outstanding
+func (e *Endpoint) Acquire() {
+	e.inFlight.Add(1)
+}
+
+// Release undoes Acquire
+func (e *Endpoint) Release() {
+	e.inFlight.Add(-1)
+}
+
+// InFlight returns the number of outstanding requests or connections
+func (e *Endpoint) InFlight() int64 {
+	return e.inFlight.Load()
+}
+
+// Observe records the outcome of a request in the circuit breaker. Only
+// successful requests feed the latency average, so a node that fails fast
+// does not look attractive.
+func (e *Endpoint) Observe(latency time.Duration, ok bool) {
+	e.breaker.record(e, ok, time.Now())
+	if !ok {
+		return
+	}
+	for {
+		old := e.latency.Load()
+		next := int64(latency)
+		if old != 0 {
+			next = int64(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(old))
+		}
+		if e.latency.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// Latency returns the smoothed request latency, or 0 if nothing was measured yet
+func (e *Endpoint) Latency() time.Duration {
+	return time.Duration(e.latency.Load())
+}
+
+// Circuit returns the endpoint's circuit breaker state
+func (e *Endpoint) Circuit() BreakerState {
+	return e.breaker.current()
+}
+
+// Healthy reports whether the endpoint is currently in rotation
+func (e *Endpoint) Healthy() bool {
+	return e.healthy.Load()
+}
+
+func (e *Endpoint) setHealthy(ok bool) {
+	e.healthy.Store(ok)
+	v := 0.0
+	if ok {
+		v = 1
+	}
+	metrics.UpstreamHealthy.WithLabelValues(e.Chain, e.Transport, e.Label()).Set(v)
+}
+
+// Height returns the latest block height seen on the endpoint, or 0 if unknown
+func (e *Endpoint) Height() uint64 {
+	return e.height.Load()
+}
+
+func (e *Endpoint) setHeight(h uint64) {
+	e.height.Store(h)
+	metrics.UpstreamBlockHeight.WithLabelValues(e.Chain, e.Transport, e.Label()).Set(float64(h))
+}
+
+// Chain holds the endpoints configured for one chain
+type Chain struct {
+	Name   string
+	Type   string
+	Config config.Chain
+	Health config.HealthCheck
+	HTTP   []*Endpoint
+	WS     []*Endpoint
+
+	httpBalancer Balancer
+	wsBalancer   Balancer
+}
+
+// Endpoints returns the endpoints for transport that are in rotation: healthy
+// and within MaxBlockLag of the chain's leader. Each filter is dropped again
+// if it would leave nothing, since trying a possibly-dead or lagging node
+// beats refusing the request outright.
+func (c *Chain) Endpoints(transport string) []*Endpoint {
+	all := c.HTTP
+	if transport == WS {
+		all = c.WS
+	}
+
+	healthy := make([]*Endpoint, 0, len(all))
+	for _, e := range all {
+		if e.Healthy() {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+
+	if c.Health.MaxBlockLag == 0 {
+		return healthy
+	}
+	leader := c.Leader()
+	synced := make([]*Endpoint, 0, len(healthy))
+	for _, e := range healthy {
+		if h := e.Height(); h == 0 || h+c.Health.MaxBlockLag >= leader {
+			synced = append(synced, e)
+		}
+	}
+	if len(synced) == 0 {
+		return healthy
+	}
+	return synced
+}
+
+// Pick chooses an endpoint for transport using the chain's balancer, skipping
+// endpoints in tried unless every candidate has already been tried.
+// Endpoints with an open circuit are never picked. It returns nil if no
+// endpoint is available; the caller must report the outcome of a picked
+// endpoint through Observe.
+func (c *Chain) Pick(transport string, tried map[*Endpoint]bool) *Endpoint {
+	now := time.Now()
+
+	candidates := make([]*Endpoint, 0, len(c.HTTP)+len(c.WS))
+	for _, e := range c.Endpoints(transport) {
+		if e.breaker.available(now) {
+			candidates = append(candidates, e)
+		}
+	}
+
+	if len(tried) > 0 {
+		untried := make([]*Endpoint, 0, len(candidates))
+		for _, e := range candidates {
+			if !tried[e] {
+				untried = append(untried, e)
+			}
+		}
+		if len(untried) > 0 {
+			candidates = untried
+		}
+	}
+
+	balancer := c.httpBalancer
+	if transport == WS {
+		balancer = c.wsBalancer
+	}
+
+	// Another request may take the last half-open slot between available and
+	// allow, so fall back to the remaining candidates
+	for len(candidates) > 0 {
+		e := balancer.Pick(candidates)
+		if e.breaker.allow(e, now) {
+			return e
+		}
+		candidates = slices.DeleteFunc(candidates, func(x *Endpoint) bool { return x == e })
+	}
+	return nil
+}
+
+// Leader returns the highest block height reported by any healthy endpoint of
+// the chain, across both transports.
+func (c *Chain) Leader() uint64 {
+	var leader uint64
+	for _, e := range c.all() {
+		if h := e.Height(); e.Healthy() && h > leader {
+			leader = h
+		}
+	}
+	return leader
+}
+
+func (c *Chain) all() []*Endpoint {
+	return append(append(make([]*Endpoint, 0, len(c.HTTP)+len(c.WS)), c.HTTP...), c.WS...)
+}
+
+// Pool is the live set of upstream endpoints for every configured chain
+type Pool struct {
+	mu     sync.RWMutex
+	chains map[string]*Chain
+}
+
+func NewPool(cm *config.ChainMap) *Pool {
+	p := &Pool{chains: map[string]*Chain{}}
+	p.Update(cm)
+	return p
+}
+
+// Chain returns the named chain, or nil if it is not configured
+func (p *Pool) Chain(name string) *Chain {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.chains[name]
+}
+
+// Chains returns a snapshot of all configured chains
+func (p *Pool) Chains() []*Chain {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	chains := make([]*Chain, 0, len(p.chains))
+	for _, c := range p.chains {
+		chains = append(chains, c)
+	}
+	return chains
+}
+
+// Update swaps in the endpoints from a newly loaded chain map, reusing
+// existing Endpoint state where the chain, transport and URL are unchanged.
+func (p *Pool) Update(cm *config.ChainMap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Current endpoints by chain|transport|URL, and the labels of their series
+	existing := map[string]*Endpoint{}
+	published := map[*Endpoint]string{}
+	for _, c := range p.chains {
+		for _, e := range c.all() {
+			existing[e.Chain+"|"+e.Transport+"|"+e.URL] = e
+			published[e] = e.Label()
+		}
+	}
+
+	reused := map[*Endpoint]bool{}
+	reuse := func(chain, transport string, ep config.Endpoint) *Endpoint {
+		if e, ok := existing[chain+"|"+transport+"|"+ep.URL]; ok && !reused[e] {
+			reused[e] = true
+			e.reconfigure(ep)
+			return e
+		}
+		return newEndpoint(chain, transport, ep)
+	}
+
+	chains := make(map[string]*Chain, len(cm.Chains))
+	for name, cfg := range cm.Chains {
+		c := &Chain{
+			Name:         name,
+			Type:         cfg.Type,
+			Config:       cfg,
+			Health:       cm.HealthCheckFor(name),
+			httpBalancer: NewBalancer(cfg.Balancer),
+			wsBalancer:   NewBalancer(cfg.Balancer),
+		}
+		for _, ep := range cfg.HTTP {
+			if ep.URL != "" {
+				c.HTTP = append(c.HTTP, reuse(name, HTTP, ep))
+			}
+		}
+		for _, ep := range cfg.WS {
+			if ep.URL != "" {
+				c.WS = append(c.WS, reuse(name, WS, ep))
+			}
+		}
+		for _, e := range c.all() {
+			e.breaker.configure(cm.CircuitBreaker)
+		}
+		chains[name] = c
+	}
+
+	// Drop series under labels no endpoint uses any more: those of removed
+	// endpoints and the old labels of renamed ones
+	inUse := map[string]bool{}
+	for _, c := range chains {
+		for _, e := range c.all() {
+			inUse[e.Chain+"|"+e.Transport+"|"+e.Label()] = true
+		}
+	}
+	for e, label := range published {
+		if inUse[e.Chain+"|"+e.Transport+"|"+label] {
+			continue
+		}
+		metrics.UpstreamHealthy.DeleteLabelValues(e.Chain, e.Transport, label)
+		metrics.UpstreamBlockHeight.DeleteLabelValues(e.Chain, e.Transport, label)
+		metrics.UpstreamBlockLag.DeleteLabelValues(e.Chain, e.Transport, label)
+		metrics.UpstreamCircuitState.DeleteLabelValues(e.Chain, e.Transport, label)
+	}
+
+	p.chains = chains
+}
@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"proxy/config"
+	"proxy/metrics"
+)
+
+func chainMap(endpoints ...config.Endpoint) *config.ChainMap {
+	return &config.ChainMap{
+		Chains:         map[string]config.Chain{"ethereum": {HTTP: endpoints}},
+		CircuitBreaker: config.CircuitBreaker{}.WithDefaults(),
+	}
+}
+
+func TestPoolUpdateKeepsEndpointState(t *testing.T) {
+	url := "https://node-a.example.com/v1/secret"
+	pool := NewPool(chainMap(config.Endpoint{URL: url, Weight: 1}))
+	e := pool.Chain("ethereum").HTTP[0]
+
+	// A dead, lagging node with an open circuit
+	e.setHealthy(false)
+	e.setHeight(100)
+	e.Observe(50*time.Millisecond, true)
+	failures := chainMap().CircuitBreaker.ConsecutiveFailures
+	for range failures {
+		e.Observe(time.Millisecond, false)
+	}
+	if e.Circuit() != Open {
+		t.Fatalf("circuit = %s, want open", e.Circuit())
+	}
+	latency := e.Latency()
+
+	tests := []struct {
+		name     string
+		endpoint config.Endpoint
+		label    string
+		weight   int
+	}{
+		{"weight change", config.Endpoint{URL: url, Weight: 5}, "node-a.example.com", 5},
+		{"rename", config.Endpoint{URL: url, Name: "primary", Weight: 5}, "primary", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool.Update(chainMap(tt.endpoint))
+
+			got := pool.Chain("ethereum").HTTP[0]
+			if got != e {
+				t.Fatal("endpoint was replaced")
+			}
+			if got.Weight() != tt.weight || got.Label() != tt.label {
+				t.Errorf("weight %d, label %s; want %d, %s", got.Weight(), got.Label(), tt.weight, tt.label)
+			}
+			if got.Healthy() || got.Height() != 100 || got.Circuit() != Open || got.Latency() != latency {
+				t.Errorf("state reset: healthy %v, height %d, circuit %s, latency %v", got.Healthy(), got.Height(), got.Circuit(), got.Latency())
+			}
+			if v := testutil.ToFloat64(metrics.UpstreamHealthy.WithLabelValues("ethereum", HTTP, tt.label)); v != 0 {
+				t.Errorf("healthy gauge = %v, want 0", v)
+			}
+		})
+	}
+
+	// The series of the name used before the rename is gone
+	if metrics.UpstreamHealthy.DeleteLabelValues("ethereum", HTTP, "node-a.example.com") {
+		t.Error("series under the old label kept")
+	}
+
+	// A new URL is a new endpoint
+	pool.Update(chainMap(config.Endpoint{URL: "https://node-b.example.com"}))
+	if got := pool.Chain("ethereum").HTTP[0]; got == e || !got.Healthy() || got.Circuit() != Closed {
+		t.Error("new URL did not get a fresh endpoint")
+	}
+	if metrics.UpstreamHealthy.DeleteLabelValues("ethereum", HTTP, "primary") {
+		t.Error("series of the removed endpoint kept")
+	}
+}
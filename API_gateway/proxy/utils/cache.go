@@ -1,15 +1,58 @@
 package utils
 
 import (
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 )
 
+// Now is the clock used for quota windows and rate limits; tests can replace it
+var Now = time.Now
+
 type APIUsage struct {
-	Count      int64
-	LastUpdate time.Time
+	Count       int64
+	LastUpdate  time.Time
+	WindowStart time.Time
+	ResetAt     time.Time
+}
+
+// UsageStore keeps the request count of every key for its current quota window
+type UsageStore interface {
+	// Increment charges n requests to apiKey unless that would take it over
+	// quota.Limit in the current window. It returns a copy of the usage after
+	// the call and whether the requests were allowed.
+	Increment(apiKey string, quota Quota, n int64) (APIUsage, bool)
+	// Delete forgets the key's usage, including per-chain counts kept under
+	// "<apiKey>|<chain>"
+	Delete(apiKey string)
+}
+
+// IncrementAPIUsage charges cost units against the key's quota. It returns
+// false if they do not fit into what is left of the current window, along
+// with the usage so callers can report the window's reset time.
+func IncrementAPIUsage(store UsageStore, apiKey string, quota Quota, cost int64) (APIUsage, bool) {
+	return store.Increment(apiKey, quota, cost)
+}
+
+// Allows reports whether n more requests fit into the quota given the usage
+func (q Quota) Allows(usage *APIUsage, n int64) bool {
+	return q.Limit == 0 || usage.Count+n <= int64(q.Limit)
+}
+
+// MemoryUsageStore keeps usage in process memory. Counts are lost on
+// restart and are not shared between replicas.
+type MemoryUsageStore struct {
+	usageCache    *cache.Cache
+	usageMutexMap *sync.Map
+
+	chainsMu sync.Mutex
+	chains   map[string]map[string]struct{} // per-chain usage keys of each key
+}
+
+func NewMemoryUsageStore(usageCache *cache.Cache, usageMutexMap *sync.Map) *MemoryUsageStore {
+	return &MemoryUsageStore{usageCache: usageCache, usageMutexMap: usageMutexMap, chains: map[string]map[string]struct{}{}}
 }
 
 func GetUsage(apiKey string, usageCache *cache.Cache) *APIUsage {
@@ -20,28 +63,13 @@ func GetUsage(apiKey string, usageCache *cache.Cache) *APIUsage {
 	return usagePtr.(*APIUsage)
 }
 
-func SetUsage(apiKey string, usageCache *cache.Cache, usage *APIUsage, expire bool) {
-	if expire {
-		usageCache.Set(apiKey, usage, cache.DefaultExpiration)
-	} else {
-		usageCache.Set(apiKey, usage, cache.NoExpiration)
+// SetUsage stores usage until the end of its quota window
+func SetUsage(apiKey string, usageCache *cache.Cache, usage *APIUsage) {
+	ttl := usage.ResetAt.Sub(Now())
+	if ttl <= 0 {
+		ttl = time.Second
 	}
-}
-
-func UpdateUsage(apiKey string, usageCache *cache.Cache, usageMutexMap *sync.Map) {
-	mutex := getMutex(apiKey, usageMutexMap)
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	usage := GetUsage(apiKey, usageCache)
-	if usage == nil {
-		usage = &APIUsage{Count: 0, LastUpdate: time.Now()}
-	}
-
-	usage.Count++
-	usage.LastUpdate = time.Now()
-
-	SetUsage(apiKey, usageCache, usage, true)
+	usageCache.Set(apiKey, usage, ttl)
 }
 
 func getMutex(key string, usageMutexMap *sync.Map) *sync.Mutex {
@@ -49,29 +77,60 @@ func getMutex(key string, usageMutexMap *sync.Map) *sync.Mutex {
 	return actualMutex.(*sync.Mutex)
 }
 
-func IncrementAPIUsage(apiKey string, limit int, usageCache *cache.Cache, usageMutexMap *sync.Map) bool {
+func (s *MemoryUsageStore) Increment(apiKey string, quota Quota, n int64) (APIUsage, bool) {
 	// Retrieve the mutex for the specified API key
-	usageMutex := getMutex(apiKey, usageMutexMap)
+	usageMutex := getMutex(apiKey, s.usageMutexMap)
 
 	// Lock the mutex to ensure exclusive access to the usage value for this API key
 	usageMutex.Lock()
 	defer usageMutex.Unlock()
 
-	// Load the usage for the API key
-	usage := GetUsage(apiKey, usageCache)
-	if usage == nil {
-		// Initialize usage if not found
-		usage = &APIUsage{Count: 1, LastUpdate: time.Now()}
-		SetUsage(apiKey, usageCache, usage, usage.Count == 1)
-	} else {
-		// Increment the usage count
-		if limit != 0 && usage.Count >= int64(limit) {
-			return false
+	now := Now()
+
+	// Load the usage for the API key, starting a new window if the last one is over
+	usage := GetUsage(apiKey, s.usageCache)
+	if usage == nil || !now.Before(usage.ResetAt) {
+		if usage == nil {
+			s.indexChain(apiKey)
 		}
-		usage.Count++
+		start, reset := quota.Window(now)
+		usage = &APIUsage{WindowStart: start, ResetAt: reset, LastUpdate: now}
+		SetUsage(apiKey, s.usageCache, usage)
+	}
+
+	if !quota.Allows(usage, n) {
+		return *usage, false
+	}
+
+	// Increment the usage count
+	usage.Count += n
+	usage.LastUpdate = now
+	return *usage, true
+}
+
+// indexChain records a "<apiKey>|<chain>" usage key under its key, so Delete
+// finds it without scanning the whole cache
+func (s *MemoryUsageStore) indexChain(usageKey string) {
+	apiKey, _, perChain := strings.Cut(usageKey, "|")
+	if !perChain {
+		return
+	}
+	s.chainsMu.Lock()
+	defer s.chainsMu.Unlock()
+	if s.chains[apiKey] == nil {
+		s.chains[apiKey] = map[string]struct{}{}
 	}
+	s.chains[apiKey][usageKey] = struct{}{}
+}
+
+func (s *MemoryUsageStore) Delete(apiKey string) {
+	s.usageCache.Delete(apiKey)
 
-	// Update the entry in the cache
-	//setUsage(apiKey, usage, usage.Count == 1) // If count was 1, then it's an initialization
-	return true
+	s.chainsMu.Lock()
+	usageKeys := s.chains[apiKey]
+	delete(s.chains, apiKey)
+	s.chainsMu.Unlock()
+	for k := range usageKeys {
+		s.usageCache.Delete(k)
+	}
 }
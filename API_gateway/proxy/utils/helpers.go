@@ -1,61 +1,54 @@
 package utils
 
 import (
-	"github.com/valyala/fasthttp"
+	"encoding/json"
 	"log"
 	"net/url"
+	"strconv"
 	"strings"
+
+	"github.com/valyala/fasthttp"
 )
 
-// ExtractAPIKeyAndPath extracts API key and path from request context
-func ExtractAPIKeyAndPath(ctx *fasthttp.RequestCtx) (string, string, error) {
-	uri := string(ctx.RequestURI())
-	parsedURI, err := url.Parse(uri)
-	if err != nil {
-		return "", "", err
-	}
-	path := parsedURI.Path
-	apiKey := extractAPIKey(path)
+// extractAPIKey extracts the API key from an /api=<key> segment, which may
+// follow a chain prefix (/<chain>/api=<key>)
+func extractAPIKey(path string) string {
+	_, apiKey, _ := SplitKeyPath(path)
+	return apiKey
+}
 
-	// If API key is not found in path, check headers
-	if apiKey == "" {
-		apiKey = string(ctx.Request.Header.Peek("X-API-Key"))
+// SplitKeyPath splits a request path around its api=<key> segment, which is
+// either the first or the second segment. prefix is the segment before the
+// key, if any, and rest the segments after it. Without a key segment, rest
+// is every segment of the path.
+func SplitKeyPath(path string) (prefix, apiKey string, rest []string) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i := 0; i < len(segments) && i < 2; i++ {
+		if key, ok := strings.CutPrefix(segments[i], "api="); ok {
+			if i == 1 {
+				prefix = segments[0]
+			}
+			return prefix, key, segments[i+1:]
+		}
 	}
-
-	return apiKey, path, nil
+	return "", "", segments
 }
 
-// extractAPIKey extracts API key from the query string
-func extractAPIKey(queryString string) string {
-	parts := strings.Split(queryString, "=")
-	if len(parts) < 2 || parts[0] != "/api" {
+// ForwardPath joins the path segments to forward upstream and the query
+// string. It returns an empty path if there are no segments.
+func ForwardPath(segments []string, queryString string) string {
+	if len(segments) == 0 {
 		return ""
 	}
-
-	keys := strings.Split(parts[1], "/")
-	return keys[0]
-}
-
-// ExtractAdditionalPath extracts additional path information
-func ExtractAdditionalPath(path string, queryString string) string {
-	parts := strings.Split(path, "/")
-	if len(parts) > 2 {
-		// parts[0] will be an empty string because the string starts with '/'
-		remainingParts := parts[2:]
-		reconstructedPath := "/" + strings.Join(remainingParts, "/")
-
-		if queryString != "" {
-			decodedQueryString, err := url.QueryUnescape(queryString)
-			if err != nil {
-				return ""
-			}
-			reconstructedPath = reconstructedPath + "?" + decodedQueryString
+	path := "/" + strings.Join(segments, "/")
+	if queryString != "" {
+		decodedQueryString, err := url.QueryUnescape(queryString)
+		if err != nil {
+			return ""
 		}
-
-		return reconstructedPath
-	} else {
-		return ""
+		path = path + "?" + decodedQueryString
 	}
+	return path
 }
 
 // isWebSocketRequest checks if the request is a WebSocket upgrade request
@@ -66,5 +59,38 @@ func IsWebSocketRequest(ctx *fasthttp.RequestCtx) bool {
 // HandleProxyError handles errors during proxy requests
 func HandleProxyError(ctx *fasthttp.RequestCtx, err error) {
 	log.Printf("Error proxying request: %s", err)
-	ctx.Error("Error proxying request", fasthttp.StatusInternalServerError)
+	WriteJSONError(ctx, "Error proxying request", fasthttp.StatusInternalServerError)
+}
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteJSONError replaces the response body with a JSON error. Unlike
+// ctx.Error it keeps headers already set on the response, such as
+// Retry-After and the RateLimit headers.
+func WriteJSONError(ctx *fasthttp.RequestCtx, msg string, statusCode int) {
+	body, _ := json.Marshal(errorBody{Error: errorDetail{Code: statusCode, Message: msg}})
+	ctx.SetStatusCode(statusCode)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// SetRateLimitHeaders reports the key's quota state in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. Unlimited keys get none.
+func SetRateLimitHeaders(ctx *fasthttp.RequestCtx, quota Quota, usage APIUsage) {
+	if quota.Limit == 0 {
+		return
+	}
+	remaining := max(int64(quota.Limit)-usage.Count, 0)
+	reset := max(int64(usage.ResetAt.Sub(Now()).Seconds()), 0)
+
+	ctx.Response.Header.Set("RateLimit-Limit", strconv.Itoa(quota.Limit))
+	ctx.Response.Header.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	ctx.Response.Header.Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
 }
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"os"
+	"time"
+)
+
+// Quota periods
+const (
+	QuotaDaily   = "daily"   // resets at 00:00 UTC
+	QuotaMonthly = "monthly" // resets every month on the billing anchor's day and time
+	QuotaRolling = "rolling" // resets 24h after the first request of the window
+)
+
+// Quota is the request budget of an API key
+type Quota struct {
+	Limit  int // 0 means unlimited
+	Period string
+	Anchor time.Time // billing anchor for monthly quotas
+}
+
+// DefaultQuotaPeriod is used for keys without a quota_period (DEFAULT_QUOTA_PERIOD, default daily)
+func DefaultQuotaPeriod() string {
+	if p := os.Getenv("DEFAULT_QUOTA_PERIOD"); IsQuotaPeriod(p) {
+		return p
+	}
+	return QuotaDaily
+}
+
+// IsQuotaPeriod reports whether p is a known quota period
+func IsQuotaPeriod(p string) bool {
+	return p == QuotaDaily || p == QuotaMonthly || p == QuotaRolling
+}
+
+// Window returns the start and reset time of the quota window containing now
+func (q Quota) Window(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+
+	switch q.Period {
+	case QuotaMonthly:
+		start := anchorInMonth(now.Year(), now.Month(), q.Anchor)
+		if start.After(now) {
+			start = anchorInMonth(now.Year(), now.Month()-1, q.Anchor)
+		}
+		return start, anchorInMonth(start.Year(), start.Month()+1, q.Anchor)
+
+	case QuotaRolling:
+		return now, now.Add(24 * time.Hour)
+
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// anchorInMonth returns the anchor's day and time of day in the given month,
+// clamped to the last day for short months. A zero anchor means the 1st at
+// 00:00 UTC.
+func anchorInMonth(year int, month time.Month, anchor time.Time) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC) // normalises month overflow
+	if anchor.IsZero() {
+		return first
+	}
+	anchor = anchor.UTC()
+
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return time.Date(first.Year(), first.Month(), min(anchor.Day(), lastDay),
+		anchor.Hour(), anchor.Minute(), anchor.Second(), 0, time.UTC)
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func date(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestQuotaWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		quota      Quota
+		now        time.Time
+		start, end time.Time
+	}{
+		{
+			name:  "daily mid-day",
+			quota: Quota{Period: QuotaDaily},
+			now:   date(2025, time.March, 10, 15, 30),
+			start: date(2025, time.March, 10, 0, 0),
+			end:   date(2025, time.March, 11, 0, 0),
+		},
+		{
+			name:  "daily at midnight starts the new day",
+			quota: Quota{Period: QuotaDaily},
+			now:   date(2025, time.March, 11, 0, 0),
+			start: date(2025, time.March, 11, 0, 0),
+			end:   date(2025, time.March, 12, 0, 0),
+		},
+		{
+			name:  "daily uses UTC for other zones",
+			quota: Quota{Period: QuotaDaily},
+			now:   time.Date(2025, time.March, 10, 23, 30, 0, 0, time.FixedZone("UTC-5", -5*3600)),
+			start: date(2025, time.March, 11, 0, 0),
+			end:   date(2025, time.March, 12, 0, 0),
+		},
+		{
+			name:  "daily over new year",
+			quota: Quota{Period: QuotaDaily},
+			now:   date(2025, time.December, 31, 23, 59),
+			start: date(2025, time.December, 31, 0, 0),
+			end:   date(2026, time.January, 1, 0, 0),
+		},
+		{
+			name:  "monthly without anchor",
+			quota: Quota{Period: QuotaMonthly},
+			now:   date(2025, time.April, 17, 8, 0),
+			start: date(2025, time.April, 1, 0, 0),
+			end:   date(2025, time.May, 1, 0, 0),
+		},
+		{
+			name:  "monthly anchor on the 31st before February's clamped day",
+			quota: Quota{Period: QuotaMonthly, Anchor: date(2025, time.January, 31, 10, 0)},
+			now:   date(2025, time.February, 15, 0, 0),
+			start: date(2025, time.January, 31, 10, 0),
+			end:   date(2025, time.February, 28, 10, 0),
+		},
+		{
+			name:  "monthly anchor on the 31st after February's clamped day",
+			quota: Quota{Period: QuotaMonthly, Anchor: date(2025, time.January, 31, 10, 0)},
+			now:   date(2025, time.March, 1, 0, 0),
+			start: date(2025, time.February, 28, 10, 0),
+			end:   date(2025, time.March, 31, 10, 0),
+		},
+		{
+			name:  "monthly anchor on the 31st in a leap year",
+			quota: Quota{Period: QuotaMonthly, Anchor: date(2023, time.May, 31, 0, 0)},
+			now:   date(2024, time.February, 29, 12, 0),
+			start: date(2024, time.February, 29, 0, 0),
+			end:   date(2024, time.March, 31, 0, 0),
+		},
+		{
+			name:  "monthly window from December into January",
+			quota: Quota{Period: QuotaMonthly, Anchor: date(2024, time.June, 15, 0, 0)},
+			now:   date(2025, time.December, 20, 0, 0),
+			start: date(2025, time.December, 15, 0, 0),
+			end:   date(2026, time.January, 15, 0, 0),
+		},
+		{
+			name:  "monthly in January before the anchor day",
+			quota: Quota{Period: QuotaMonthly, Anchor: date(2024, time.June, 15, 0, 0)},
+			now:   date(2026, time.January, 5, 0, 0),
+			start: date(2025, time.December, 15, 0, 0),
+			end:   date(2026, time.January, 15, 0, 0),
+		},
+		{
+			name:  "rolling",
+			quota: Quota{Period: QuotaRolling},
+			now:   date(2025, time.March, 10, 15, 30),
+			start: date(2025, time.March, 10, 15, 30),
+			end:   date(2025, time.March, 11, 15, 30),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.quota.Window(tt.now)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("Window(%v) = %v, %v; want %v, %v", tt.now, start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+// setNow points the quota clock at *now for the rest of the test
+func setNow(t *testing.T, now *time.Time) {
+	t.Helper()
+	Now = func() time.Time { return *now }
+	t.Cleanup(func() { Now = time.Now })
+}
+
+// usageStep advances the clock, charges one request and expects the result
+type usageStep struct {
+	advance time.Duration
+	allowed bool
+	count   int64
+}
+
+func TestMemoryUsageStoreIncrement(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota Quota
+		start time.Time
+		steps []usageStep
+	}{
+		{
+			name:  "daily resets at UTC midnight",
+			quota: Quota{Limit: 2, Period: QuotaDaily},
+			start: date(2025, time.March, 10, 23, 58),
+			steps: []usageStep{
+				{0, true, 1},
+				{time.Minute, true, 2},
+				{30 * time.Second, false, 2},
+				{30 * time.Second, true, 1}, // 00:00
+			},
+		},
+		{
+			name:  "monthly resets on the clamped anchor day",
+			quota: Quota{Limit: 1, Period: QuotaMonthly, Anchor: date(2025, time.January, 31, 0, 0)},
+			start: date(2025, time.February, 27, 23, 0),
+			steps: []usageStep{
+				{0, true, 1},
+				{30 * time.Minute, false, 1},
+				{30 * time.Minute, true, 1}, // Feb 28 00:00
+			},
+		},
+		{
+			name:  "rolling resets 24h after the window's first request",
+			quota: Quota{Limit: 1, Period: QuotaRolling},
+			start: date(2025, time.March, 10, 15, 0),
+			steps: []usageStep{
+				{0, true, 1},
+				{23 * time.Hour, false, 1},
+				{time.Hour - time.Second, false, 1},
+				{time.Second, true, 1},
+				{12 * time.Hour, false, 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := tt.start
+			setNow(t, &now)
+			store := NewMemoryUsageStore(cache.New(time.Hour, time.Hour), &sync.Map{})
+
+			for i, step := range tt.steps {
+				now = now.Add(step.advance)
+				usage, allowed := store.Increment("key", tt.quota, 1)
+				if allowed != step.allowed || usage.Count != step.count {
+					t.Errorf("step %d at %v: allowed %v count %d; want %v %d", i, now, allowed, usage.Count, step.allowed, step.count)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryUsageStoreDelete(t *testing.T) {
+	store := NewMemoryUsageStore(cache.New(time.Hour, time.Hour), &sync.Map{})
+	quota := Quota{Limit: 10, Period: QuotaDaily}
+	for _, k := range []string{"key", "key|ethereum", "key|base", "key2|ethereum"} {
+		store.Increment(k, quota, 1)
+	}
+
+	// The key's shared and per-chain counts are forgotten, other keys' are kept
+	store.Delete("key")
+	for k, want := range map[string]int64{"key": 0, "key|ethereum": 0, "key|base": 0, "key2|ethereum": 1} {
+		if usage, _ := store.Increment(k, quota, 0); usage.Count != want {
+			t.Errorf("%s count = %d, want %d", k, usage.Count, want)
+		}
+	}
+
+	// Per-chain counts started after a delete are found by the next one
+	store.Increment("key|base", quota, 1)
+	store.Delete("key")
+	if usage, _ := store.Increment("key|base", quota, 0); usage.Count != 0 {
+		t.Errorf("key|base count = %d after the second delete, want 0", usage.Count)
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket holds the tokens left for one API key
+type TokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func getBucket(apiKey string, burst float64, rateLimitMap *sync.Map) *TokenBucket {
+	if b, found := rateLimitMap.Load(apiKey); found {
+		return b.(*TokenBucket)
+	}
+	b, _ := rateLimitMap.LoadOrStore(apiKey, &TokenBucket{tokens: burst, last: Now()})
+	return b.(*TokenBucket)
+}
+
+// AllowRequest takes a token from the key's bucket. When the bucket is empty
+// it returns false together with how long until the next token is available.
+// A rate of 0 disables the per-second limit; a burst of 0 defaults to one
+// second's worth of requests.
+func AllowRequest(apiKey string, rate float64, burst int, rateLimitMap *sync.Map) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+	capacity := float64(burst)
+	if burst <= 0 {
+		capacity = math.Max(rate, 1)
+	}
+
+	b := getBucket(apiKey, capacity, rateLimitMap)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := Now()
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// RetryAfterSeconds rounds a wait up to whole seconds for the Retry-After header
+func RetryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rateStep advances the clock, takes one token and expects the result
+type rateStep struct {
+	advance time.Duration
+	allowed bool
+	wait    time.Duration // expected wait when refused
+}
+
+func TestAllowRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []rateStep
+	}{
+		{
+			name: "burst then refill",
+			rate: 2, burst: 3,
+			steps: []rateStep{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, 500 * time.Millisecond},
+				{250 * time.Millisecond, false, 250 * time.Millisecond},
+				{250 * time.Millisecond, true, 0},
+				{0, false, 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "refill is capped at the burst",
+			rate: 10, burst: 2,
+			steps: []rateStep{
+				{0, true, 0},
+				{0, true, 0},
+				{time.Hour, true, 0},
+				{0, true, 0},
+				{0, false, 100 * time.Millisecond},
+			},
+		},
+		{
+			name: "burst defaults to one second of requests",
+			rate: 2,
+			steps: []rateStep{
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "rates below one still allow one request",
+			rate: 0.5,
+			steps: []rateStep{
+				{0, true, 0},
+				{0, false, 2 * time.Second},
+				{time.Second, false, time.Second},
+				{time.Second, true, 0},
+			},
+		},
+		{
+			name: "zero rate is unlimited",
+			rate: 0, burst: 1,
+			steps: []rateStep{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := date(2025, time.March, 10, 12, 0)
+			setNow(t, &now)
+			buckets := &sync.Map{}
+
+			for i, step := range tt.steps {
+				now = now.Add(step.advance)
+				allowed, wait := AllowRequest("key", tt.rate, tt.burst, buckets)
+				if allowed != step.allowed || wait != step.wait {
+					t.Errorf("step %d: AllowRequest = %v, %v; want %v, %v", i, allowed, wait, step.allowed, step.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowRequestKeysAreSeparate(t *testing.T) {
+	now := date(2025, time.March, 10, 12, 0)
+	setNow(t, &now)
+	buckets := &sync.Map{}
+
+	if ok, _ := AllowRequest("a", 1, 1, buckets); !ok {
+		t.Fatal("first request of a refused")
+	}
+	if ok, _ := AllowRequest("a", 1, 1, buckets); ok {
+		t.Error("second request of a allowed")
+	}
+	if ok, _ := AllowRequest("b", 1, 1, buckets); !ok {
+		t.Error("b was charged for a's requests")
+	}
+}
+
+func TestAllowRequestConcurrent(t *testing.T) {
+	now := date(2025, time.March, 10, 12, 0)
+	setNow(t, &now)
+	buckets := &sync.Map{}
+
+	// With the clock stopped, exactly the burst is let through
+	const burst = 50
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := AllowRequest("key", 10, burst, buckets); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed.Load() != burst {
+		t.Errorf("%d requests allowed, want %d", allowed.Load(), burst)
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{0, 1},
+		{100 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1001 * time.Millisecond, 2},
+	}
+	for _, tt := range tests {
+		if got := RetryAfterSeconds(tt.wait); got != tt.want {
+			t.Errorf("RetryAfterSeconds(%v) = %d, want %d", tt.wait, got, tt.want)
+		}
+	}
+}
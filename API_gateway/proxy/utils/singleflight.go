@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightPanicked = errors.New("shared call panicked")
+
+// Group collapses concurrent calls that share a key into one execution
+type Group[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flight[V]
+}
+
+type flight[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+}
+
+// Do runs fn once for all callers that ask for key while it is in flight and
+// hands each of them the same result. joined reports whether the caller
+// waited on a call started by someone else.
+func (g *Group[V]) Do(key string, fn func() (V, error)) (v V, err error, joined bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight[V])
+	}
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.val, f.err, true
+	}
+	// Callers waiting on a call that panics get an error instead of a zero value
+	f := &flight[V]{err: errFlightPanicked}
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		f.wg.Done()
+	}()
+
+	f.val, f.err = fn()
+	return f.val, f.err, false
+}
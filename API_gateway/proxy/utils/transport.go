@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Places a request can carry its API key
+const (
+	KeyInPath      = "path"      // /api=<key>/... or /<chain>/api=<key>/...
+	KeyInHeader    = "header"    // X-API-Key: <key>
+	KeyInBearer    = "bearer"    // Authorization: Bearer <key>
+	KeyInQuery     = "query"     // ?apikey=<key>
+	KeyInSubdomain = "subdomain" // <key>.rpc.example.com
+)
+
+var keyTransports = []string{KeyInPath, KeyInHeader, KeyInBearer, KeyInQuery, KeyInSubdomain}
+
+// KeyExtractor finds the API key of a request in the configured transports,
+// trying them in order
+type KeyExtractor struct {
+	transports []string
+	queryParam string
+	hostSuffix string
+}
+
+// NewKeyExtractor checks the transport list. hostSuffix is the domain the
+// subdomain transport expects keys under, e.g. rpc.example.com.
+func NewKeyExtractor(transports []string, queryParam, hostSuffix string) (*KeyExtractor, error) {
+	if len(transports) == 0 {
+		return nil, fmt.Errorf("no API key transports configured")
+	}
+	for _, t := range transports {
+		known := false
+		for _, k := range keyTransports {
+			known = known || t == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown API key transport %q, expected one of %v", t, keyTransports)
+		}
+		if t == KeyInSubdomain && hostSuffix == "" {
+			return nil, fmt.Errorf("the subdomain transport requires KEY_HOST_SUFFIX")
+		}
+		if t == KeyInQuery && queryParam == "" {
+			return nil, fmt.Errorf("the query transport requires a parameter name")
+		}
+	}
+	if hostSuffix != "" && !strings.HasPrefix(hostSuffix, ".") {
+		hostSuffix = "." + hostSuffix
+	}
+	return &KeyExtractor{transports: transports, queryParam: queryParam, hostSuffix: strings.ToLower(hostSuffix)}, nil
+}
+
+// Extract returns the API key, the transport it was found in and the request
+// path. Keys sent in the Authorization header or the query string are removed
+// from the request so they are not forwarded upstream.
+func (e *KeyExtractor) Extract(ctx *fasthttp.RequestCtx) (apiKey, transport, path string, err error) {
+	parsedURI, err := url.Parse(string(ctx.RequestURI()))
+	if err != nil {
+		return "", "", "", err
+	}
+	path = parsedURI.Path
+
+	for _, t := range e.transports {
+		switch t {
+		case KeyInPath:
+			apiKey = extractAPIKey(path)
+		case KeyInHeader:
+			apiKey = string(ctx.Request.Header.Peek("X-API-Key"))
+		case KeyInBearer:
+			if token, ok := cutBearer(string(ctx.Request.Header.Peek("Authorization"))); ok {
+				apiKey = token
+				ctx.Request.Header.Del("Authorization")
+			}
+		case KeyInQuery:
+			if v := ctx.QueryArgs().Peek(e.queryParam); len(v) > 0 {
+				apiKey = string(v)
+				ctx.QueryArgs().Del(e.queryParam)
+			}
+		case KeyInSubdomain:
+			apiKey = e.subdomainKey(string(ctx.Host()))
+		}
+		if apiKey != "" {
+			return apiKey, t, path, nil
+		}
+	}
+	return "", "", path, nil
+}
+
+// cutBearer returns the token of an "Authorization: Bearer <token>" value
+func cutBearer(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// CheckKey refuses keys the configured transports can't carry. With the
+// subdomain transport enabled, keys must be valid lowercase host labels, as
+// clients and proxies lowercase host names.
+func (e *KeyExtractor) CheckKey(apiKey string) error {
+	subdomain := false
+	for _, t := range e.transports {
+		subdomain = subdomain || t == KeyInSubdomain
+	}
+	if !subdomain {
+		return nil
+	}
+	if len(apiKey) > 63 {
+		return fmt.Errorf("keys sent as a subdomain can't be longer than 63 characters")
+	}
+	for _, c := range apiKey {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("keys sent as a subdomain may only contain lowercase letters, digits and hyphens")
+		}
+	}
+	return nil
+}
+
+// subdomainKey returns the first label of host if the rest of it is the
+// configured suffix
+func (e *KeyExtractor) subdomainKey(host string) string {
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), e.hostSuffix)
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
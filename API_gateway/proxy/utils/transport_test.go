@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// request builds a request context for uri with the given Host and headers
+func request(uri, host string, headers map[string]string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.SetHost(host)
+	for name, value := range headers {
+		ctx.Request.Header.Set(name, value)
+	}
+	return ctx
+}
+
+func TestKeyExtractorExtract(t *testing.T) {
+	all := []string{KeyInPath, KeyInHeader, KeyInBearer, KeyInQuery, KeyInSubdomain}
+
+	tests := []struct {
+		name       string
+		transports []string
+		uri        string
+		host       string
+		headers    map[string]string
+		key        string
+		transport  string
+		path       string
+	}{
+		{"path", all, "/api=pathkey/rpc", "gw.example.com", nil, "pathkey", KeyInPath, "/api=pathkey/rpc"},
+		{"path after chain", all, "/base/api=pathkey", "gw.example.com", nil, "pathkey", KeyInPath, "/base/api=pathkey"},
+		{"header", all, "/base", "gw.example.com", map[string]string{"X-API-Key": "headerkey"}, "headerkey", KeyInHeader, "/base"},
+		{"bearer", all, "/", "gw.example.com", map[string]string{"Authorization": "Bearer bearerkey"}, "bearerkey", KeyInBearer, "/"},
+		{"bearer scheme is case-insensitive", all, "/", "gw.example.com", map[string]string{"Authorization": "bearer  bearerkey "}, "bearerkey", KeyInBearer, "/"},
+		{"basic auth is not a key", all, "/", "gw.example.com", map[string]string{"Authorization": "Basic dXNlcjpwdw=="}, "", "", "/"},
+		{"query", all, "/base?apikey=querykey", "gw.example.com", nil, "querykey", KeyInQuery, "/base"},
+		{"subdomain", all, "/", "subkey.rpc.example.com", nil, "subkey", KeyInSubdomain, "/"},
+		{"no key", all, "/base/rpc", "gw.example.com", nil, "", "", "/base/rpc"},
+		{
+			name:       "path wins over every other transport",
+			transports: all,
+			uri:        "/api=pathkey?apikey=querykey",
+			host:       "subkey.rpc.example.com",
+			headers:    map[string]string{"X-API-Key": "headerkey", "Authorization": "Bearer bearerkey"},
+			key:        "pathkey",
+			transport:  KeyInPath,
+			path:       "/api=pathkey",
+		},
+		{
+			name:       "header wins over bearer, query and subdomain",
+			transports: all,
+			uri:        "/?apikey=querykey",
+			host:       "subkey.rpc.example.com",
+			headers:    map[string]string{"X-API-Key": "headerkey", "Authorization": "Bearer bearerkey"},
+			key:        "headerkey",
+			transport:  KeyInHeader,
+			path:       "/",
+		},
+		{
+			name:       "configured order decides precedence",
+			transports: []string{KeyInSubdomain, KeyInQuery, KeyInPath},
+			uri:        "/api=pathkey?apikey=querykey",
+			host:       "subkey.rpc.example.com",
+			key:        "subkey",
+			transport:  KeyInSubdomain,
+			path:       "/api=pathkey",
+		},
+		{
+			name:       "transports not configured are ignored",
+			transports: []string{KeyInPath},
+			uri:        "/base?apikey=querykey",
+			host:       "subkey.rpc.example.com",
+			headers:    map[string]string{"X-API-Key": "headerkey"},
+			path:       "/base",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewKeyExtractor(tt.transports, "apikey", "rpc.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, transport, path, err := e.Extract(request(tt.uri, tt.host, tt.headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tt.key || transport != tt.transport || path != tt.path {
+				t.Errorf("Extract(%s) = %q, %q, %q; want %q, %q, %q", tt.uri, key, transport, path, tt.key, tt.transport, tt.path)
+			}
+		})
+	}
+}
+
+func TestKeyExtractorRemovesForwardedKeys(t *testing.T) {
+	e, err := NewKeyExtractor([]string{KeyInBearer, KeyInQuery}, "apikey", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := request("/base?apikey=querykey&block=latest", "gw.example.com", nil)
+	if key, _, _, _ := e.Extract(ctx); key != "querykey" {
+		t.Fatalf("query key = %q", key)
+	}
+	if got := string(ctx.QueryArgs().QueryString()); got != "block=latest" {
+		t.Errorf("query string after Extract = %q, want block=latest", got)
+	}
+
+	ctx = request("/base", "gw.example.com", map[string]string{"Authorization": "Bearer bearerkey"})
+	if key, _, _, _ := e.Extract(ctx); key != "bearerkey" {
+		t.Fatalf("bearer key = %q", key)
+	}
+	if got := ctx.Request.Header.Peek("Authorization"); got != nil {
+		t.Errorf("Authorization after Extract = %q, want it removed", got)
+	}
+
+	// A header that isn't a bearer token is left for the upstream
+	ctx = request("/base", "gw.example.com", map[string]string{"Authorization": "Basic dXNlcjpwdw=="})
+	e.Extract(ctx)
+	if got := string(ctx.Request.Header.Peek("Authorization")); got != "Basic dXNlcjpwdw==" {
+		t.Errorf("Authorization after Extract = %q, want it kept", got)
+	}
+}
+
+func TestSubdomainKey(t *testing.T) {
+	e := &KeyExtractor{hostSuffix: ".rpc.example.com"}
+
+	tests := []struct {
+		host string
+		key  string
+	}{
+		{"abc.rpc.example.com", "abc"},
+		{"abc.rpc.example.com:8443", "abc"},
+		{"ABC.RPC.Example.com", "abc"},
+		{"x.abc.rpc.example.com", ""},
+		{"rpc.example.com", ""},
+		{".rpc.example.com", ""},
+		{"abc.rpc.example.org", ""},
+		{"abcrpc.example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := e.subdomainKey(tt.host); got != tt.key {
+			t.Errorf("subdomainKey(%s) = %q, want %q", tt.host, got, tt.key)
+		}
+	}
+}
+
+func TestKeyExtractorCheckKey(t *testing.T) {
+	subdomain, _ := NewKeyExtractor([]string{KeyInHeader, KeyInSubdomain}, "apikey", "rpc.example.com")
+	header, _ := NewKeyExtractor([]string{KeyInHeader}, "apikey", "")
+
+	tests := []struct {
+		key       string
+		subdomain bool // accepted with the subdomain transport
+	}{
+		{"abc-123", true},
+		{"AbC123", false},
+		{"abc_123", false},
+		{"abc.123", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, tt := range tests {
+		if err := subdomain.CheckKey(tt.key); (err == nil) != tt.subdomain {
+			t.Errorf("CheckKey(%s) with the subdomain transport = %v, want accepted %v", tt.key, err, tt.subdomain)
+		}
+		if err := header.CheckKey(tt.key); err != nil {
+			t.Errorf("CheckKey(%s) without the subdomain transport = %v", tt.key, err)
+		}
+	}
+}